@@ -0,0 +1,195 @@
+package simplerpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+// Credentials are the key/value pairs client sends to authenticate itself
+type Credentials map[string]string
+
+// Authenticator validates the credentials of client in the handshake,
+// challenge is the random bytes server sent to client for this
+// connection. It returns the identity of client, which is read from
+// Peer.Identity, or an error to reject the connection.
+type Authenticator func(ctx context.Context, challenge []byte, creds Credentials) (identity string, err error)
+
+// CredentialsProvider returns the credentials of client for challenge,
+// it's called on every handshake, so tokens are refreshed on reconnect
+type CredentialsProvider func(ctx context.Context, challenge []byte) (Credentials, error)
+
+// errUnauthenticated is sent to clients which don't authenticate
+// to a server with an authenticator
+var errUnauthenticated = NewError(CodeUnauthenticated, "rpc server: authentication required")
+
+// authChallenge is sent by server after option if client authenticates
+type authChallenge struct {
+	Challenge []byte
+}
+
+// authResult is sent by server after it validates the credentials
+type authResult struct {
+	Code  Code
+	Error string
+}
+
+// SetAuthenticator sets the authenticator of server, connections of
+// clients which don't send valid credentials are rejected. nil means
+// every client is accepted.
+func (server *Server) SetAuthenticator(auth Authenticator) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.auth = auth
+}
+
+// SetAuthenticator sets the authenticator of DefaultServer
+func SetAuthenticator(auth Authenticator) { DefaultServer.SetAuthenticator(auth) }
+
+// authenticate runs the challenge-response handshake of opt on conn,
+// it returns false if the connection is rejected
+func (server *Server) authenticate(conn io.ReadWriteCloser, dec *json.Decoder, opt *Option, f codec.NewCodecFunc, remote *Peer) bool {
+	server.mu.Lock()
+	auth := server.auth
+	server.mu.Unlock()
+
+	if !opt.Auth {
+		if auth == nil {
+			return true
+		}
+		// client reads the error frame with its codec
+		h := &codec.Header{}
+		setHeaderError(h, errUnauthenticated)
+		_ = f(conn).Write(h, invalidRequest)
+		return false
+	}
+
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		log.Println("rpc server: auth challenge error:", err)
+		return false
+	}
+	if err := writeJSON(conn, authChallenge{Challenge: challenge}); err != nil {
+		log.Println("rpc server: auth challenge error:", err)
+		return false
+	}
+	var creds Credentials
+	if err := dec.Decode(&creds); err != nil {
+		log.Println("rpc server: auth credentials error:", err)
+		return false
+	}
+
+	var err error
+	if auth != nil {
+		remote.Identity, err = auth(context.Background(), challenge, creds)
+	}
+	var result authResult
+	if err != nil {
+		log.Println("rpc server: authentication failed:", err)
+		result.Code, result.Error = CodeUnauthenticated, "rpc server: authentication failed: "+err.Error()
+	}
+	if werr := writeJSON(conn, result); werr != nil {
+		log.Println("rpc server: auth result error:", werr)
+		return false
+	}
+	return err == nil
+}
+
+// clientAuthenticate answers the challenge of server read by dec
+// on conn with the credentials of opt
+func clientAuthenticate(conn net.Conn, dec *json.Decoder, opt *Option) error {
+	var ch authChallenge
+	if err := dec.Decode(&ch); err != nil {
+		return err
+	}
+	creds, err := opt.Credentials(context.Background(), ch.Challenge)
+	if err != nil {
+		return err
+	}
+	if err = writeJSON(conn, creds); err != nil {
+		return err
+	}
+	var result authResult
+	if err = dec.Decode(&result); err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return NewError(result.Code, result.Error)
+	}
+	return nil
+}
+
+// writeJSON writes v without a trailing newline, so that the
+// next message starts right after it
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// BearerCredentials sends the token returned by token as credentials,
+// token is called on every handshake
+func BearerCredentials(token func(ctx context.Context) (string, error)) CredentialsProvider {
+	return func(ctx context.Context, _ []byte) (Credentials, error) {
+		t, err := token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return Credentials{"token": t}, nil
+	}
+}
+
+// BearerAuthenticator validates the token sent by BearerCredentials with
+// verify, which returns the identity of token
+func BearerAuthenticator(verify func(ctx context.Context, token string) (string, error)) Authenticator {
+	return func(ctx context.Context, _ []byte, creds Credentials) (string, error) {
+		token, ok := creds["token"]
+		if !ok {
+			return "", errors.New("missing token")
+		}
+		return verify(ctx, token)
+	}
+}
+
+// HMACCredentials answers the challenge of server with its HMAC-SHA256
+// signed by secret, the secret itself is never sent
+func HMACCredentials(keyID string, secret []byte) CredentialsProvider {
+	return func(_ context.Context, challenge []byte) (Credentials, error) {
+		return Credentials{"key-id": keyID, "signature": hex.EncodeToString(hmacSign(secret, challenge))}, nil
+	}
+}
+
+// HMACAuthenticator validates the signature sent by HMACCredentials with
+// the secret of its key id, the identity of client is the key id
+func HMACAuthenticator(secret func(keyID string) ([]byte, bool)) Authenticator {
+	return func(_ context.Context, challenge []byte, creds Credentials) (string, error) {
+		keyID := creds["key-id"]
+		key, ok := secret(keyID)
+		if !ok {
+			return "", errors.New("unknown key id " + keyID)
+		}
+		sig, err := hex.DecodeString(creds["signature"])
+		if err != nil || !hmac.Equal(sig, hmacSign(key, challenge)) {
+			return "", errors.New("invalid signature")
+		}
+		return keyID, nil
+	}
+}
+
+func hmacSign(secret, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
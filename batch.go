@@ -0,0 +1,140 @@
+package simplerpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+// Batch collects calls which are sent to server in one frame, server
+// handles them concurrently and responds each of them as it finishes.
+// Interceptors of client are not applied to the calls of a batch.
+type Batch struct {
+	client *Client
+	calls  []*Call
+}
+
+// Batch returns an empty batch of client
+func (client *Client) Batch() *Batch {
+	return &Batch{client: client}
+}
+
+// Add adds a call to b, the returned Call is done when its
+// reply arrives
+func (b *Batch) Add(serviceMethod string, args, reply interface{}) *Call {
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+	}
+	b.calls = append(b.calls, call)
+	return call
+}
+
+// Go sends the calls of b without waiting for them, each call
+// is done on its own Done channel. b must not be sent again.
+func (b *Batch) Go(ctx context.Context) {
+	for _, call := range b.calls {
+		call.ctx = ctx
+	}
+	if len(b.calls) > 0 {
+		b.client.sendBatch(ctx, b.calls)
+	}
+}
+
+// Do sends the calls of b and waits for all of them to complete,
+// it returns the first error of the calls in the order they are added
+func (b *Batch) Do(ctx context.Context) error {
+	b.Go(ctx)
+	var err error
+	for _, call := range b.calls {
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+			// tell server to stop handling the call if it is still pending
+			if b.client.removeCall(call.Seq) != nil {
+				b.client.cancel(call.Seq)
+				call.Error = toError(fmt.Errorf("rpc client: call failed: %w", ctx.Err()))
+				call.done()
+			}
+			<-call.Done
+		}
+		if err == nil {
+			err = call.Error
+		}
+	}
+	return err
+}
+
+// sendBatch registers calls with consecutive seqs and sends them in one frame
+func (client *Client) sendBatch(ctx context.Context, calls []*Call) {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+
+	// register calls together, so their seqs are consecutive
+	client.mu.Lock()
+	if client.closing || client.shutdown {
+		client.mu.Unlock()
+		for _, call := range calls {
+			call.Error = ErrShutdown
+			call.done()
+		}
+		return
+	}
+	for _, call := range calls {
+		call.Seq = client.seq
+		client.pending[call.Seq] = call
+		client.seq++
+	}
+	client.mu.Unlock()
+
+	h := &codec.Header{Seq: calls[0].Seq, Kind: codec.KindBatch}
+	h.Metadata, _ = FromOutgoingContext(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		h.Timeout = time.Until(deadline)
+		if h.Timeout <= 0 {
+			client.failCalls(calls, NewError(CodeDeadlineExceeded, "rpc client: call failed: "+context.DeadlineExceeded.Error()))
+			return
+		}
+	}
+	bodies := make([]interface{}, len(calls))
+	for i, call := range calls {
+		h.Batch = append(h.Batch, call.ServiceMethod)
+		bodies[i] = call.Args
+	}
+
+	var err error
+	if bw, ok := client.cc.(codec.BatchWriter); ok {
+		err = bw.WriteBatch(h, bodies)
+	} else {
+		// codec can't write a batch, send the calls one by one
+		for _, call := range calls {
+			client.header.ServiceMethod = call.ServiceMethod
+			client.header.Seq = call.Seq
+			client.header.Error = ""
+			client.header.Kind = codec.KindCall
+			client.header.Timeout = h.Timeout
+			client.header.Metadata = h.Metadata
+			if err = client.cc.Write(&client.header, call.Args); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		client.failCalls(calls, err)
+	}
+}
+
+// failCalls completes calls which are still pending with err
+func (client *Client) failCalls(calls []*Call, err error) {
+	for _, call := range calls {
+		// call may have been handled, if Write partially failed
+		if client.removeCall(call.Seq) != nil {
+			call.Error = err
+			call.done()
+		}
+	}
+}
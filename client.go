@@ -1,7 +1,9 @@
 package simplerpc
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,16 +18,22 @@ import (
 
 // Call represents an use of RPC.
 type Call struct {
-	Seq           uint64
+	Seq           uint64      // with interceptors, valid only after Done
 	ServiceMethod string      // format "<service>.<method>"
 	Args          interface{} // arguments to the function
 	Reply         interface{} // reply from the function
 	Error         error       // if error occurs, it will be set
 	Done          chan *Call  // Strobes when call is complete.
+	Metadata      Metadata    // metadata of response, valid only after Done
+	ctx           context.Context
+	stream        *clientStream // messages of a streaming call
 }
 
 // done is used when rpc complete serve
 func (call *Call) done() {
+	if call.stream != nil {
+		call.stream.finish()
+	}
 	call.Done <- call
 }
 
@@ -36,13 +44,20 @@ func (call *Call) done() {
 type Client struct {
 	cc       codec.Codec
 	opt      *Option
-	sending  sync.Mutex // protect following
-	mu       sync.Mutex // protect following
+	sending  *sync.Mutex // protect following, shared with sc
+	mu       sync.Mutex  // protect following
 	header   codec.Header
 	seq      uint64
 	pending  map[uint64]*Call // store unserved calls
 	closing  bool             // user has called Close
 	shutdown bool             // server has told us to stop
+	err      error            // error of server which rejects the connection
+	// interceptors wrap every Call and Go
+	interceptors []ClientInterceptor
+	// server and sc serve the calls which server makes on client
+	server *Server
+	sc     *serverConn
+	ack    *HandshakeAck // reply of server to option
 }
 
 var _ io.Closer = (*Client)(nil)
@@ -56,7 +71,7 @@ type clientResult struct {
 type newClientFunc func(conn net.Conn, opt *Option) (client *Client, err error)
 
 // ErrShutdown default errors when connect shut down
-var ErrShutdown = errors.New("connection is shut down")
+var ErrShutdown = NewError(CodeUnavailable, "connection is shut down")
 
 // Close close the connection
 func (client *Client) Close() error {
@@ -87,6 +102,9 @@ func (client *Client) registerCall(call *Call) (uint64, error) {
 
 	// check if the client actived because mu Lock,
 	// so don't use IsAvailable
+	if client.err != nil {
+		return 0, client.err
+	}
 	if client.closing || client.shutdown {
 		return 0, ErrShutdown
 	}
@@ -115,6 +133,10 @@ func (client *Client) terminateCalls(err error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	client.shutdown = true
+	// new calls get the error if server rejects the connection
+	if _, ok := err.(*Error); ok {
+		client.err = err
+	}
 	for _, call := range client.pending {
 		call.Error = err
 		call.done()
@@ -130,29 +152,74 @@ func (client *Client) receive() {
 		if err = client.cc.ReadHeader(&h); err != nil {
 			break
 		}
-		call := client.removeCall(h.Seq)
-		switch {
-		case call == nil:
-			// it usually means that Write partially failed
-			// and call was already removed.
-			err = client.cc.ReadBody(nil)
-		case h.Error != "":
-			// server serve err
-			call.Error = fmt.Errorf(h.Error)
-			err = client.cc.ReadBody(nil)
-			call.done()
-		default:
-			// success served, read msg from body
-			err = client.cc.ReadBody(call.Reply)
-			if err != nil {
-				call.Error = errors.New("reading body " + err.Error())
-			}
-			call.done()
+		// a call which server makes on client
+		if h.Reverse {
+			err = client.server.serveMessage(client.sc, &h)
+			continue
 		}
+		err = client.receiveResponse(&h)
 	}
 
 	// error occurs, so terminateCalls pending calls
 	client.terminateCalls(err)
+	// and stop serving the calls made by server
+	client.sc.calls.Range(func(_, cancel interface{}) bool {
+		cancel.(context.CancelFunc)()
+		return true
+	})
+}
+
+// receiveResponse reads the body of message h sent to client
+func (client *Client) receiveResponse(h *codec.Header) error {
+	// server rejects the connection, such as unauthenticated
+	if h.Seq == 0 && h.Error != "" {
+		_ = client.cc.ReadBody(nil)
+		return headerError(h)
+	}
+	// server is shutting down, stop sending new calls but
+	// keep receiving responses of pending calls
+	if h.Kind == codec.KindGoAway {
+		client.mu.Lock()
+		client.shutdown = true
+		client.mu.Unlock()
+		return client.cc.ReadBody(nil)
+	}
+	// a message or window update of a streaming call, the call stays
+	// pending until the end of stream arrives as its response
+	if h.Kind == codec.KindStream || h.Kind == codec.KindWindow {
+		return client.receiveStream(h)
+	}
+	call := client.removeCall(h.Seq)
+	if call != nil {
+		call.Metadata = h.Metadata
+	}
+	var err error
+	switch {
+	case call == nil:
+		// it usually means that Write partially failed
+		// and call was already removed.
+		err = client.cc.ReadBody(nil)
+	case h.Error != "":
+		// server serve err
+		call.Error = headerError(h)
+		err = client.cc.ReadBody(nil)
+		call.done()
+	default:
+		// success served, read msg from body
+		err = client.cc.ReadBody(call.Reply)
+		if errors.Is(err, codec.ErrTooLarge) {
+			call.Error = NewError(CodeResourceExhausted, "reading body "+err.Error())
+		} else if err != nil {
+			call.Error = NewError(CodeInternal, "reading body "+err.Error())
+		}
+		// only the call fails if its framed body can't be decoded
+		var de *codec.DecodeError
+		if errors.As(err, &de) {
+			err = nil
+		}
+		call.done()
+	}
+	return err
 }
 
 // NewClient get new client
@@ -165,22 +232,73 @@ func NewClient(conn net.Conn, opt *Option) (*Client, error) {
 		return nil, err
 	}
 	// send options with server
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
+	o := *opt
+	o.Auth = opt.Credentials != nil
+	o.Version = ProtocolVersion
+	if newCodecFunc(opt.CodecType, o.Version) == nil {
+		o.Version = framedVersion - 1
+	}
+	if opt.LegacyHandshake {
+		o.Version = 0
+	}
+	if err := json.NewEncoder(conn).Encode(&o); err != nil {
 		log.Println("rpc client: options error: ", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), opt), nil
+	if o.Version == 0 && !o.Auth {
+		return newClientCodec(f(conn), opt), nil
+	}
+
+	// read what server replies to option
+	dec := json.NewDecoder(conn)
+	var ack *HandshakeAck
+	var err error
+	if o.Version > 0 {
+		ack, err = readAckWithin(conn, dec, opt)
+		// servers older than the ack serve the option as it is
+		if err == errNoAck && !o.Auth {
+			log.Println("rpc client: server doesn't acknowledge the handshake, fall back to legacy handshake")
+			return newClientCodec(f(conn), opt), nil
+		}
+	}
+	if err == nil && o.Auth {
+		err = clientAuthenticate(conn, dec, opt)
+	}
+	if err != nil {
+		log.Println("rpc client: handshake error:", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	if ack != nil {
+		f = withCompression(newCodecFunc(opt.CodecType, ack.Version), ack.Compression, opt.CompressThreshold)
+	}
+	// the decoder may have read ahead, codec reads the buffered bytes first
+	buffered, _ := io.ReadAll(dec.Buffered())
+	client := newClientCodec(f(&bufferedConn{io.MultiReader(bytes.NewReader(buffered), conn), conn}), opt)
+	client.ack = ack
+	return client, nil
+}
+
+// Handshake returns the ack of server to the option of client, it's
+// nil if client is dialed with LegacyHandshake or server doesn't ack
+func (client *Client) Handshake() *HandshakeAck {
+	return client.ack
 }
 
 // newClientCodec create new client and receive serve msg
 func newClientCodec(cc codec.Codec, opt *Option) *Client {
 	client := &Client{
-		seq:     1, // seq starts with 1, 0 means invalid call
-		cc:      cc,
-		opt:     opt,
-		pending: make(map[uint64]*Call),
+		seq:          1, // seq starts with 1, 0 means invalid call
+		cc:           cc,
+		opt:          opt,
+		sending:      new(sync.Mutex),
+		pending:      make(map[uint64]*Call),
+		interceptors: opt.Interceptors,
+		server:       NewServer(),
 	}
+	client.sc = &serverConn{cc: reverseCodec{cc}, opt: opt, sending: client.sending, peer: client}
+	opt.Limits.apply(cc)
 	go client.receive()
 	return client
 }
@@ -213,6 +331,10 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 	if err != nil {
 		return nil, err
 	}
+	// handshake happens on first write, within the connect timeout
+	if opt.TLSConfig != nil {
+		conn = tls.Client(conn, tlsConfigFor(opt.TLSConfig, address))
+	}
 	// close the connection if client is nil
 	defer func() {
 		if err != nil {
@@ -239,6 +361,21 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 	}
 }
 
+// tlsConfigFor returns config with ServerName set to the host of address
+// if it's empty, so that the certificate of server can be verified
+func tlsConfigFor(config *tls.Config, address string) *tls.Config {
+	if config.ServerName != "" || config.InsecureSkipVerify {
+		return config
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
 // Dial connects to an RPC server at the specified network address
 func Dial(network, address string, opts ...*Option) (*Client, error) {
 	return dialTimeout(NewClient, network, address, opts...)
@@ -258,10 +395,23 @@ func (client *Client) send(call *Call) {
 		return
 	}
 
-	// prepare request header
+	// prepare request header, the remaining deadline of ctx
+	// tells the server how long the caller will wait
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.Kind = codec.KindCall
+	client.header.Timeout = 0
+	client.header.Metadata, _ = FromOutgoingContext(call.ctx)
+	if deadline, ok := call.ctx.Deadline(); ok {
+		client.header.Timeout = time.Until(deadline)
+		if client.header.Timeout <= 0 {
+			client.removeCall(seq)
+			call.Error = NewError(CodeDeadlineExceeded, "rpc client: call failed: "+context.DeadlineExceeded.Error())
+			call.done()
+			return
+		}
+	}
 
 	// encode and send the request
 	if err := client.cc.Write(&client.header, call.Args); err != nil {
@@ -275,9 +425,111 @@ func (client *Client) send(call *Call) {
 	}
 }
 
+// cancel sends a cancel message so that server stops handling
+// the call with seq, the response of it will be discarded
+func (client *Client) cancel(seq uint64) {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	// server may still handle the call after it has told us to stop
+	client.mu.Lock()
+	closing := client.closing
+	client.mu.Unlock()
+	if closing {
+		return
+	}
+
+	client.header.ServiceMethod = ""
+	client.header.Seq = seq
+	client.header.Error = ""
+	client.header.Kind = codec.KindCancel
+	client.header.Timeout = 0
+	client.header.Metadata = nil
+	if err := client.cc.Write(&client.header, invalidRequest); err != nil {
+		log.Println("rpc client: cancel error:", err)
+	}
+}
+
+// Notify invokes the function without waiting for it, server runs
+// the function but never responds, so its reply and error are lost.
+// It runs through the interceptors of client with a nil reply and
+// sends the metadata of ctx, it returns the error of sending the request.
+func (client *Client) Notify(ctx context.Context, serviceMethod string, args interface{}, opts ...CallOption) error {
+	for _, opt := range opts {
+		ctx = opt(ctx)
+	}
+	return client.intercept(func(ctx context.Context, serviceMethod string, args, _ interface{}) error {
+		return client.notify(ctx, serviceMethod, args)
+	})(ctx, serviceMethod, args, nil)
+}
+
+// notify sends the one-way call to server
+func (client *Client) notify(ctx context.Context, serviceMethod string, args interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return toError(fmt.Errorf("rpc client: notify failed: %w", err))
+	}
+	client.sending.Lock()
+	defer client.sending.Unlock()
+
+	// a seq is still taken so that server can tell requests apart,
+	// but nothing is registered in pending
+	client.mu.Lock()
+	if client.closing || client.shutdown {
+		client.mu.Unlock()
+		return ErrShutdown
+	}
+	seq := client.seq
+	client.seq++
+	client.mu.Unlock()
+
+	client.header.ServiceMethod = serviceMethod
+	client.header.Seq = seq
+	client.header.Error = ""
+	client.header.Kind = codec.KindNotify
+	client.header.Timeout = 0
+	client.header.Metadata, _ = FromOutgoingContext(ctx)
+	return client.cc.Write(&client.header, args)
+}
+
 // Go invokes the function asynchronously.
 // It returns the Call structure representing the invocation.
+// With interceptors the call is sent once they run in background, so
+// Seq and Metadata of the call must not be read until it's done, they
+// are those of the last call the interceptors sent.
 func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	if !client.hasInterceptors() {
+		return client.goContext(context.Background(), serviceMethod, args, reply, done)
+	}
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		log.Panic("rpc client: done channel is unbuffered")
+	}
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
+		ctx:           context.Background(),
+	}
+	// interceptors are synchronous, so run them in background,
+	// the call they send fills the fields of call
+	go func() {
+		call.Error = client.intercept(func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			sent := client.goContext(ctx, serviceMethod, args, reply, make(chan *Call, 1))
+			call.Seq = sent.Seq
+			completed, err := client.wait(ctx, sent)
+			if completed {
+				call.Metadata = sent.Metadata
+			}
+			return err
+		})(call.ctx, serviceMethod, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+// goContext is Go with a ctx whose deadline is sent along with the request
+func (client *Client) goContext(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
@@ -288,20 +540,43 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
+		ctx:           ctx,
 	}
 	client.send(call)
 	return call
 }
 
 // Call invokes the named function, waits for it to complete,
-// and returns its error status. user can use ctx to set expire time
-func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+// and returns its error status. user can use ctx to set expire time,
+// the remaining deadline of ctx is propagated to the server.
+// opts can set metadata of request or read metadata of response.
+func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...CallOption) error {
+	for _, opt := range opts {
+		ctx = opt(ctx)
+	}
+	return client.intercept(client.call)(ctx, serviceMethod, args, reply)
+}
+
+// call sends the call to server and waits for it to complete
+func (client *Client) call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	_, err := client.wait(ctx, client.goContext(ctx, serviceMethod, args, reply, make(chan *Call, 1)))
+	return err
+}
+
+// wait waits for call to complete or ctx to be done, completed
+// tells whether call is complete, so that its fields can be read
+func (client *Client) wait(ctx context.Context, call *Call) (completed bool, err error) {
 	select {
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		// tell server to stop handling the call if it is still pending
+		if client.removeCall(call.Seq) != nil {
+			client.cancel(call.Seq)
+		}
+		return false, toError(fmt.Errorf("rpc client: call failed: %w", ctx.Err()))
 	case call := <-call.Done:
-		return call.Error
+		if md, ok := ctx.Value(readMetadataKey{}).(*Metadata); ok {
+			*md = call.Metadata
+		}
+		return true, call.Error
 	}
 }
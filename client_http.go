@@ -2,6 +2,7 @@ package simplerpc
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -34,7 +35,9 @@ func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
 // XDial calls different functions to connect to a RPC server
 // according the first parameter rpcAddr.
 // rpcAddr is a general format (protocol@addr) to represent a rpc server
-// eg, http@10.0.0.1:7001, tcp@10.0.0.1:9999, unix@/tmp/geerpc.sock
+// eg, http@10.0.0.1:7001, tcp@10.0.0.1:9999, unix@/tmp/geerpc.sock,
+// tls@10.0.0.1:9999 and https@10.0.0.1:7001 connect over TLS with the
+// TLSConfig of option, or the default config if it's nil
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
@@ -44,8 +47,33 @@ func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	switch protocol {
 	case "http":
 		return DialHTTP("tcp", addr, opts...)
+	case "https":
+		opt, err := withTLS(opts...)
+		if err != nil {
+			return nil, err
+		}
+		return DialHTTP("tcp", addr, opt)
+	case "tls":
+		opt, err := withTLS(opts...)
+		if err != nil {
+			return nil, err
+		}
+		return Dial("tcp", addr, opt)
 	default:
 		// tcp, unix or other transport protocol
 		return Dial(protocol, addr, opts...)
 	}
 }
+
+// withTLS returns a copy of option which always connects over TLS
+func withTLS(opts ...*Option) (*Option, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	o := *opt
+	if o.TLSConfig == nil {
+		o.TLSConfig = &tls.Config{}
+	}
+	return &o, nil
+}
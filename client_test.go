@@ -2,12 +2,18 @@ package simplerpc
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"os"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
 )
 
 func TestClient_dialTimeout(t *testing.T) {
@@ -36,10 +42,58 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
+func (b Bar) Deadline(ctx context.Context, argv int, reply *time.Duration) error {
+	if argv < 0 {
+		err := NewError(CodeNotFound, "negative argv", fmt.Sprintf("argv %d", argv))
+		if argv == -2 {
+			return fmt.Errorf("loading deadline: %w", err)
+		}
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.New("no deadline")
+	}
+	*reply = time.Until(deadline)
+	return nil
+}
+
+// barCanceled receives a value when Bar.Cancel is cancelled by client
+var barCanceled = make(chan struct{}, 1)
+
+func (b Bar) Cancel(ctx context.Context, argv int, reply *int) error {
+	select {
+	case <-ctx.Done():
+		barCanceled <- struct{}{}
+		return ctx.Err()
+	case <-time.After(time.Second * 5):
+		return nil
+	}
+}
+
+func (b Bar) Sleep(ms int, reply *int) error {
+	time.Sleep(time.Millisecond * time.Duration(ms))
+	*reply = ms
+	return nil
+}
+
+func (b Bar) Panic(argv int, reply *int) error {
+	panic("bar panic")
+}
+
+func startBarServer(addrCh chan string) {
+	var b Bar
+	l, _ := net.Listen("tcp", ":0")
+	server := NewServer()
+	_ = server.Register(&b)
+	addrCh <- l.Addr().String()
+	server.Accept(l)
+}
+
 func TestClient_Call(t *testing.T) {
 	t.Parallel()
 	addrCh := make(chan string)
-	go startServer(addrCh)
+	go startBarServer(addrCh)
 	addr := <-addrCh
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
@@ -57,6 +111,66 @@ func TestClient_Call(t *testing.T) {
 		var reply int
 		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+		_assert(errors.Is(err, context.DeadlineExceeded) && ErrorCode(err) == CodeDeadlineExceeded, "expect code DeadlineExceeded, got %v", err)
+	})
+	t.Run("error codes", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		var reply int
+		err := client.Call(context.Background(), "Bar.Unknown", 1, &reply)
+		var e *Error
+		_assert(errors.As(err, &e) && e.Code == CodeNotFound, "expect code NotFound, got %v", err)
+		err = client.Call(context.Background(), "Bar", 1, &reply)
+		_assert(ErrorCode(err) == CodeInvalidArgument, "expect code InvalidArgument, got %v", err)
+		err = client.Call(context.Background(), "Bar.Cancel", "not int", &reply)
+		_assert(ErrorCode(err) == CodeInvalidArgument, "expect code InvalidArgument, got %v", err)
+
+		var d time.Duration
+		err = client.Call(context.Background(), "Bar.Deadline", 1, &d)
+		_assert(ErrorCode(err) == CodeUnknown && err.Error() == "no deadline", "expect code Unknown, got %v", err)
+		err = client.Call(context.Background(), "Bar.Deadline", -1, &d)
+		_assert(errors.Is(err, &Error{Code: CodeNotFound}), "expect code NotFound, got %v", err)
+		_assert(len(err.(*Error).Details) == 1 && err.(*Error).Details[0] == "argv -1", "expect details, got %v", err.(*Error).Details)
+		err = client.Call(context.Background(), "Bar.Deadline", -2, &d)
+		_assert(ErrorCode(err) == CodeNotFound && err.Error() == "loading deadline: negative argv", "expect wrapped error kept, got %v", err)
+	})
+	t.Run("deadline propagation", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		defer cancel()
+		var reply time.Duration
+		err := client.Call(ctx, "Bar.Deadline", 1, &reply)
+		_assert(err == nil && reply > 0 && reply <= time.Second*2, "expect the deadline of ctx, got %v %s", err, reply)
+
+		err = client.Call(context.Background(), "Bar.Deadline", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "no deadline"), "expect no deadline without ctx deadline")
+	})
+	t.Run("server panic", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		var reply int
+		err := client.Call(context.Background(), "Bar.Panic", 1, &reply)
+		_assert(errors.Is(err, ErrPanic) && strings.Contains(err.Error(), "bar panic"), "expect a panic error, got %v", err)
+		var d time.Duration
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_assert(client.Call(ctx, "Bar.Deadline", 1, &d) == nil, "expect server still serving after panic")
+	})
+	t.Run("client cancel", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*100, cancel)
+		var reply int
+		err := client.Call(ctx, "Bar.Cancel", 1, &reply)
+		_assert(errors.Is(err, context.Canceled) && ErrorCode(err) == CodeCanceled, "expect a cancel error, got %v", err)
+		select {
+		case <-barCanceled:
+		case <-time.After(time.Second):
+			t.Fatal("expect server to cancel Bar.Cancel")
+		}
+		// connection still works after cancel
+		var d time.Duration
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_assert(client.Call(ctx, "Bar.Deadline", 1, &d) == nil, "expect the client still available")
 	})
 }
 
@@ -81,3 +195,298 @@ func TestXDial(t *testing.T) {
 		_assert(err == nil, "failed to connect unix socket")
 	}
 }
+
+func TestClient_Use(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startBarServer(addrCh)
+	addr := <-addrCh
+
+	var calls int32
+	counter := func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+		atomic.AddInt32(&calls, 1)
+		return invoker(ctx, serviceMethod, args, reply)
+	}
+	client, _ := Dial("tcp", addr, &Option{Interceptors: []ClientInterceptor{counter}})
+	client.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+		if serviceMethod == "Bar.Alias" {
+			serviceMethod = "Bar.Deadline"
+		}
+		err := invoker(ctx, serviceMethod, args, reply)
+		if err != nil {
+			return errors.New("intercepted: " + err.Error())
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var reply time.Duration
+	err := client.Call(ctx, "Bar.Alias", 1, &reply)
+	_assert(err == nil && reply > 0, "expect Bar.Alias rewritten to Bar.Deadline, got %v", err)
+
+	call := <-client.Go("Bar.Deadline", 1, &reply, nil).Done
+	_assert(call.Error != nil && strings.HasPrefix(call.Error.Error(), "intercepted: "), "expect Go intercepted, got %v", call.Error)
+	_assert(atomic.LoadInt32(&calls) == 2, "expect 2 intercepted calls, got %d", calls)
+
+	// the call sent by interceptors fills the call returned by Go
+	tenant := func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+		return invoker(NewOutgoingContext(ctx, Metadata{"tenant": "t1"}), serviceMethod, args, reply)
+	}
+	client, _ = Dial("tcp", addr, &Option{Interceptors: []ClientInterceptor{tenant}})
+	var echo string
+	call = <-client.Go("Bar.Echo", "tenant", &echo, nil).Done
+	_assert(call.Error == nil && echo == "t1", "expect ctx of interceptor sent, got %v %q", call.Error, echo)
+	_assert(call.Seq != 0 && call.Metadata["echo"] == "t1", "expect Seq and Metadata of Go set, got %d %v", call.Seq, call.Metadata)
+}
+
+func (b Bar) Echo(ctx context.Context, key string, reply *string) error {
+	md, _ := FromIncomingContext(ctx)
+	*reply = md[key]
+	SetResponseMetadata(ctx, "echo", md[key])
+	return nil
+}
+
+func TestClient_Metadata(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startBarServer(addrCh)
+	addr := <-addrCh
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType, codec.ProtobufType} {
+		client, _ := Dial("tcp", addr, &Option{CodecType: typ})
+		ctx := NewOutgoingContext(context.Background(), Metadata{"trace-id": "abc"})
+		var reply string
+		var md Metadata
+		err := client.Call(ctx, "Bar.Echo", "tenant", &reply, WithMetadata(Metadata{"tenant": "t1"}), ReadMetadata(&md))
+		_assert(err == nil && reply == "t1", "%s: expect tenant t1, got %v %q", typ, err, reply)
+		_assert(md["echo"] == "t1", "%s: expect response metadata, got %v", typ, md)
+
+		err = client.Call(ctx, "Bar.Echo", "trace-id", &reply)
+		_assert(err == nil && reply == "abc", "%s: expect trace-id abc, got %v %q", typ, err, reply)
+	}
+}
+
+// barAudited receives the events of Bar.Audit
+var barAudited = make(chan string, 1)
+
+func (b Bar) Audit(event string, reply *int) error {
+	barAudited <- event
+	return errors.New("never sent to client")
+}
+
+func TestClient_Notify(t *testing.T) {
+	t.Parallel()
+	server, addr := startShutdownServer(t)
+	audited := make(chan Metadata, 1)
+	server.Use(func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error {
+		if info.ServiceMethod == "Bar.Audit" {
+			audited <- info.Header.Metadata
+		}
+		return next(ctx, argv, reply)
+	})
+
+	client, _ := Dial("tcp", addr)
+	// notifications run through interceptors and carry the metadata of ctx
+	var intercepted []string
+	client.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+		if reply == nil {
+			intercepted = append(intercepted, serviceMethod)
+		}
+		return invoker(ctx, serviceMethod, args, reply)
+	})
+	ctx := NewOutgoingContext(context.Background(), Metadata{"trace": "1"})
+	err := client.Notify(ctx, "Bar.Audit", "login", WithMetadata(Metadata{"user": "a"}))
+	_assert(err == nil, "expect notify to be sent, got %v", err)
+	select {
+	case event := <-barAudited:
+		_assert(event == "login", "expect event login, got %q", event)
+	case <-time.After(time.Second):
+		t.Fatal("expect server to run Bar.Audit")
+	}
+	md := <-audited
+	_assert(md["trace"] == "1" && md["user"] == "a", "expect metadata sent with notify, got %v", md)
+	_assert(len(intercepted) == 1 && intercepted[0] == "Bar.Audit", "expect notify intercepted, got %v", intercepted)
+	client.mu.Lock()
+	n := len(client.pending)
+	client.mu.Unlock()
+	_assert(n == 0, "expect nothing pending, got %d", n)
+
+	// unknown methods are dropped by server too
+	err = client.Notify(context.Background(), "Bar.Unknown", 1)
+	_assert(err == nil, "expect notify to be sent, got %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+	_assert(err == nil && reply == 1, "expect Bar.Sleep to work, got %v", err)
+
+	_ = client.Close()
+	err = client.Notify(context.Background(), "Bar.Audit", "logout")
+	_assert(errors.Is(err, ErrShutdown), "expect ErrShutdown, got %v", err)
+}
+
+func TestClient_Batch(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startBarServer(addrCh)
+	addr := <-addrCh
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType, codec.ProtobufType} {
+		client, _ := Dial("tcp", addr, &Option{CodecType: typ})
+		b := client.Batch()
+		replies := make([]int, 3)
+		for i := range replies {
+			b.Add("Bar.Sleep", 100, &replies[i])
+		}
+		var unknown int
+		unknownCall := b.Add("Bar.Unknown", 1, &unknown)
+		var d time.Duration
+		deadlineCall := b.Add("Bar.Deadline", -1, &d)
+
+		start := time.Now()
+		err := b.Do(context.Background())
+		// calls are handled concurrently
+		_assert(time.Since(start) < time.Millisecond*250, "%s: expect calls handled concurrently, took %s", typ, time.Since(start))
+		_assert(ErrorCode(err) == CodeNotFound, "%s: expect first error of batch, got %v", typ, err)
+		for i, reply := range replies {
+			_assert(reply == 100, "%s: expect reply %d of Bar.Sleep, got %d", typ, i, reply)
+		}
+		_assert(ErrorCode(unknownCall.Error) == CodeNotFound, "%s: expect unknown method, got %v", typ, unknownCall.Error)
+		_assert(ErrorCode(deadlineCall.Error) == CodeNotFound, "%s: expect error of Bar.Deadline, got %v", typ, deadlineCall.Error)
+
+		// calls after the batch still work
+		var reply int
+		err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+		_assert(err == nil && reply == 1, "%s: expect Bar.Sleep to work, got %v", typ, err)
+	}
+}
+
+type Address struct {
+	City string `msgpack:"city"`
+	Zip  string `msgpack:"zip,omitempty"`
+}
+
+type Profile struct {
+	Name     string            `msgpack:"name" protobuf:"2"`
+	Avatar   []byte            `msgpack:"avatar" protobuf:"3"`
+	Created  time.Time         `msgpack:"created" protobuf:"4"`
+	Labels   map[string]string `msgpack:"labels" protobuf:"5"`
+	Scores   map[int]float64   `msgpack:"scores" protobuf:"6"`
+	Home     Address           `msgpack:"home" protobuf:"7"`
+	Previous []*Address        `msgpack:"previous" protobuf:"8"`
+	Age      int8              `msgpack:"age" protobuf:"1,zigzag"`
+	Ranks    []int32           `msgpack:"ranks" protobuf:"9"`
+	Nickname *string           `msgpack:"nickname" protobuf:"10"`
+}
+
+func (b Bar) Profile(p Profile, reply *Profile) error {
+	*reply = p
+	reply.Age++
+	return nil
+}
+
+func TestClient_Codecs(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startBarServer(addrCh)
+	addr := <-addrCh
+
+	p := Profile{
+		Name:     "gopher",
+		Avatar:   []byte{0, 1, 0xff},
+		Created:  time.Date(2024, 2, 29, 12, 30, 0, 123456789, time.UTC),
+		Labels:   map[string]string{"team": "rpc"},
+		Scores:   map[int]float64{-1: 0.5, 300: 2},
+		Home:     Address{City: "Hangzhou"},
+		Previous: []*Address{{City: "Beijing", Zip: "100000"}, {City: "Shanghai"}},
+		Age:      -3,
+		Ranks:    []int32{3, -1, 0},
+		Nickname: new(string),
+	}
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType, codec.ProtobufType} {
+		client, _ := Dial("tcp", addr, &Option{CodecType: typ})
+		var reply Profile
+		err := client.Call(context.Background(), "Bar.Profile", p, &reply)
+		_assert(err == nil, "%s: expect Bar.Profile to work, got %v", typ, err)
+		_assert(reply.Name == p.Name && string(reply.Avatar) == string(p.Avatar) && reply.Created.Equal(p.Created),
+			"%s: expect name, avatar and created round-tripped, got %+v", typ, reply)
+		_assert(reply.Labels["team"] == "rpc" && reply.Scores[-1] == 0.5 && reply.Scores[300] == 2,
+			"%s: expect maps round-tripped, got %v %v", typ, reply.Labels, reply.Scores)
+		_assert(reply.Home == p.Home && len(reply.Previous) == 2 && *reply.Previous[0] == *p.Previous[0] && *reply.Previous[1] == *p.Previous[1],
+			"%s: expect nested structs round-tripped, got %+v", typ, reply)
+		_assert(reply.Age == -2, "%s: expect age -2, got %d", typ, reply.Age)
+		_assert(len(reply.Ranks) == 3 && reply.Ranks[1] == -1, "%s: expect repeated ranks, got %v", typ, reply.Ranks)
+		// gob doesn't send zero values even if they are pointed to
+		_assert(typ == codec.GobType || reply.Nickname != nil && *reply.Nickname == "",
+			"%s: expect optional nickname present, got %v", typ, reply.Nickname)
+
+		// a body which doesn't fit is rejected without breaking the connection
+		err = client.Call(context.Background(), "Bar.Profile", "not a profile", &reply)
+		_assert(ErrorCode(err) == CodeInvalidArgument, "%s: expect code InvalidArgument, got %v", typ, err)
+		var wrong []string
+		err = client.Call(context.Background(), "Bar.Profile", p, &wrong)
+		_assert(ErrorCode(err) == CodeInternal, "%s: expect reply which doesn't fit to fail, got %v", typ, err)
+		err = client.Call(context.Background(), "Bar.Profile", p, &reply)
+		_assert(err == nil && reply.Age == -2, "%s: expect Bar.Profile to work after a bad body, got %v", typ, err)
+	}
+}
+
+func (b Bar) Export(n int, reply *string) error {
+	*reply = strings.Repeat("simple-rpc ", n)
+	return nil
+}
+
+// countConn counts the bytes read from the connection
+type countConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func TestClient_Compression(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startBarServer(addrCh)
+	addr := <-addrCh
+
+	for _, c := range []codec.Compression{codec.Gzip, codec.Deflate, codec.LZ4} {
+		conn, _ := net.Dial("tcp", addr)
+		counter := &countConn{Conn: conn}
+		client, err := NewClient(counter, &Option{MagicNumber: MagicNumber, CodecType: codec.JsonType, Compression: c})
+		_assert(err == nil, "%s: expect handshake accepted, got %v", c, err)
+		ack := client.Handshake()
+		_assert(ack.Has(CapCompression) && ack.Compression == c, "%s: expect compression acked, got %+v", c, ack)
+
+		var reply string
+		err = client.Call(context.Background(), "Bar.Export", 100000, &reply)
+		_assert(err == nil && reply == strings.Repeat("simple-rpc ", 100000), "%s: expect export, got %v", c, err)
+		n := atomic.LoadInt64(&counter.n)
+		_assert(n < int64(len(reply))/10, "%s: expect reply compressed, read %d bytes of %d", c, n, len(reply))
+
+		// requests are compressed too
+		var p Profile
+		err = client.Call(context.Background(), "Bar.Profile", Profile{Name: reply}, &p)
+		_assert(err == nil && p.Name == reply, "%s: expect compressed request, got %v", c, err)
+		_ = client.Close()
+	}
+
+	client, err := Dial("tcp", addr, &Option{Compression: "zstd"})
+	_assert(err == nil && client.Handshake().Compression == "", "expect unknown compression not acked, got %v", err)
+	var reply string
+	err = client.Call(context.Background(), "Bar.Export", 10, &reply)
+	_assert(err == nil && len(reply) == 110, "expect export without compression, got %v", err)
+
+	lz4 := codec.CompressorMap[codec.LZ4]
+	random := make([]byte, 1<<16)
+	_, _ = rand.New(rand.NewSource(1)).Read(random)
+	for _, src := range [][]byte{nil, []byte("short"), []byte(strings.Repeat("a", 70000)), random} {
+		b, err := lz4.Compress(src)
+		_assert(err == nil, "expect lz4 compress, got %v", err)
+		b, err = lz4.Decompress(b, 0)
+		_assert(err == nil && string(b) == string(src), "expect lz4 round trip of %d bytes, got %v", len(src), err)
+	}
+}
@@ -1,11 +1,37 @@
 package codec
 
-import "io"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Kind tells the receiver how to handle a message
+type Kind uint8
+
+const (
+	KindCall      Kind = iota // request or response of a call
+	KindCancel                // client gives up the call with the same Seq
+	KindGoAway                // server is shutting down, client should stop sending new calls
+	KindStream                // a message of the streaming call with the same Seq
+	KindStreamEnd             // end of the streaming call, carries its error
+	KindWindow                // window update of the stream with the same Seq, body is an uint32 count
+	KindNotify                // one-way call, server never responds to it
+	KindBatch                 // calls of Batch with Seq from Seq on, one body follows for each
+)
 
 type Header struct {
-	ServiceMethod string // format "Service.Method"
-	Seq           uint64 // Seq code from client
-	Error         string
+	ServiceMethod string            // format "Service.Method"
+	Seq           uint64            // Seq code from client
+	Error         string            // error msg from server
+	Code          uint32            // error code from server, 0 means no code
+	Details       []string          // details of error from server
+	Timeout       time.Duration     // remaining deadline of the caller, 0 means no limit
+	Kind          Kind              // message kind, 0 means a common call
+	Metadata      map[string]string // key/value pairs of request or response
+	Batch         []string          // service methods of a batch, in order of bodies
+	Reverse       bool              // message of a call which server makes on client
 }
 
 // default codec func
@@ -16,21 +42,95 @@ type Codec interface {
 	Write(*Header, interface{}) error // write msg to header and body
 }
 
+// BatchWriter is implemented by codecs which can write the bodies
+// of a batch after a single header with one flush
+type BatchWriter interface {
+	WriteBatch(*Header, []interface{}) error
+}
+
+// Limiter is implemented by codecs which bound the size of the headers
+// and bodies they read, a size of 0 means no limit
+type Limiter interface {
+	SetLimits(maxHeader, maxBody int)
+}
+
+// ErrTooLarge is wrapped by the errors of reading a header or body
+// which is larger than the limit
+var ErrTooLarge = errors.New("rpc codec: message too large")
+
+// maxDepth bounds the nesting of decoded values like encoding/json
+// does, so that deep input fails instead of overflowing the stack
+const maxDepth = 10000
+
+var errTooDeep = errors.New("rpc codec: exceeded max depth")
+
+// tooLarge returns the error of a message longer than limit bytes
+func tooLarge(limit int) error {
+	return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, limit)
+}
+
+// readChunk bounds what is allocated for a length before its bytes
+// arrive, longer ones grow as they are read
+const readChunk = 64 << 10
+
+// readFull reads n bytes from r, so that a corrupt length fails at the
+// end of input instead of allocating all of it up front
+func readFull(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, 0, min(n, readChunk))
+	for len(b) < n {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+		m, err := io.ReadFull(r, b[len(b):min(n, cap(b))])
+		b = b[:len(b)+m]
+		if err == io.EOF && len(b) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
 // NewCodecFunc init codec func
 type NewCodecFunc func(io.ReadWriteCloser) Codec
 
+// Marshaler encodes a header or body into the payload of a frame and
+// decodes it back, Unmarshal(data, nil) drops the payload
+type Marshaler interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// NewMarshalerFunc init the marshaler of a connection
+type NewMarshalerFunc func() Marshaler
+
 type Type string
 
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json"
+	GobType      Type = "application/gob"
+	JsonType     Type = "application/json"
+	MsgpackType  Type = "application/msgpack"
+	ProtobufType Type = "application/protobuf"
 )
 
 // NewCodecFuncMap store all Codec func
 var NewCodecFuncMap map[Type]NewCodecFunc
 
+// NewMarshalerFuncMap store the marshalers of FramedCodec
+var NewMarshalerFuncMap map[Type]NewMarshalerFunc
+
 func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc)
 	NewCodecFuncMap[GobType] = NewGobCodec
 	NewCodecFuncMap[JsonType] = NewJsonCodec
+	NewCodecFuncMap[MsgpackType] = NewMsgpackCodec
+	NewCodecFuncMap[ProtobufType] = NewProtobufCodec
+
+	NewMarshalerFuncMap = make(map[Type]NewMarshalerFunc)
+	NewMarshalerFuncMap[GobType] = NewGobMarshaler
+	NewMarshalerFuncMap[JsonType] = NewJsonMarshaler
+	NewMarshalerFuncMap[MsgpackType] = NewMsgpackMarshaler
+	NewMarshalerFuncMap[ProtobufType] = NewProtobufMarshaler
 }
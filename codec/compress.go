@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// Compressor compresses the payloads of frames, Decompress fails with
+// ErrTooLarge if src expands to more than limit bytes, 0 means no limit
+type Compressor interface {
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte, limit int) ([]byte, error)
+}
+
+// Compression is the name of a compressor
+type Compression string
+
+const (
+	Gzip    Compression = "gzip"
+	Deflate Compression = "deflate"
+	LZ4     Compression = "lz4" // LZ4 block prefixed by its size, fast but compresses less
+)
+
+// CompressorMap store all Compressor
+var CompressorMap = map[Compression]Compressor{
+	Gzip: &flateCompressor{
+		newWriter: func(w io.Writer) flateWriter { return gzip.NewWriter(w) },
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	Deflate: &flateCompressor{
+		newWriter: func(w io.Writer) flateWriter {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+	},
+	LZ4: lz4Compressor{},
+}
+
+// flateWriter is a gzip or flate writer, which is reused by Reset
+type flateWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// flateCompressor compresses with gzip or deflate
+type flateCompressor struct {
+	newWriter func(io.Writer) flateWriter
+	newReader func(io.Reader) (io.ReadCloser, error)
+	writers   sync.Pool // writers are large, so they are reused
+}
+
+func (c *flateCompressor) Compress(src []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, ok := c.writers.Get().(flateWriter)
+	if ok {
+		w.Reset(&b)
+	} else {
+		w = c.newWriter(&b)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (c *flateCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	r, err := c.newReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	// read one byte more than limit to tell if there are more
+	b, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err == nil && len(b) > limit {
+		return nil, tooLarge(limit)
+	}
+	return b, err
+}
@@ -0,0 +1,105 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompressor_RoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("hello"),
+		"repetitive": []byte(strings.Repeat("abcd", 1000)),
+		"long run":   bytes.Repeat([]byte{0}, 70000), // longer than the max offset
+		"random":     random,
+	}
+	for comp, c := range CompressorMap {
+		for name, in := range inputs {
+			b, err := c.Compress(in)
+			if err != nil {
+				t.Errorf("%s %s: expect compressed, got %v", comp, name, err)
+				continue
+			}
+			out, err := c.Decompress(b, len(in))
+			if err != nil || !bytes.Equal(out, in) {
+				t.Errorf("%s %s: expect decompressed, got %d bytes, %v", comp, name, len(out), err)
+			}
+		}
+	}
+}
+
+func TestCompressor_Limit(t *testing.T) {
+	in := []byte(strings.Repeat("a", 1000))
+	for comp, c := range CompressorMap {
+		b, _ := c.Compress(in)
+		if _, err := c.Decompress(b, len(in)-1); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%s: expect too large error, got %v", comp, err)
+		}
+		for _, limit := range []int{len(in), 0} {
+			if out, err := c.Decompress(b, limit); err != nil || !bytes.Equal(out, in) {
+				t.Errorf("%s: expect decompressed within %d, got %v", comp, limit, err)
+			}
+		}
+		if _, err := c.Decompress([]byte("not compressed"), 0); err == nil {
+			t.Errorf("%s: expect corrupt input rejected", comp)
+		}
+	}
+}
+
+func TestLZ4_Vectors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		out  string
+	}{
+		{"literals", []byte{0x05, 0, 0, 0, 0x50, 'h', 'e', 'l', 'l', 'o'}, "hello"},
+		{"overlapping match", []byte{0x17, 0, 0, 0, 0x3b, 'a', 'b', 'c', 0x03, 0x00, 0x50, 'X', 'Y', 'Z', 'W', 'V'},
+			strings.Repeat("abc", 6) + "XYZWV"},
+		{"long literals", append([]byte{0x10, 0, 0, 0, 0xf0, 0x01}, strings.Repeat("x", 16)...), strings.Repeat("x", 16)},
+		{"long match", []byte{0x1a, 0, 0, 0, 0x1f, 'a', 0x01, 0x00, 0x01, 0x50, 'b', 'b', 'b', 'b', 'b'},
+			strings.Repeat("a", 21) + "bbbbb"},
+		{"empty", []byte{0, 0, 0, 0, 0x00}, ""},
+	}
+	for _, tt := range tests {
+		out, err := lz4Compressor{}.Decompress(tt.in, 0)
+		if err != nil || string(out) != tt.out {
+			t.Errorf("%s: expect %q, got %q, %v", tt.name, tt.out, out, err)
+		}
+	}
+	// a block of literals only is what lz4.block of Python writes as well
+	if b, _ := (lz4Compressor{}).Compress([]byte("hello")); !bytes.Equal(b, tests[0].in) {
+		t.Errorf("expect % x, got % x", tests[0].in, b)
+	}
+}
+
+func TestLZ4_Corrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"no size", []byte{0x05, 0}},
+		{"truncated literals", []byte{0x05, 0, 0, 0, 0x50, 'h'}},
+		{"truncated literal length", []byte{0x10, 0, 0, 0, 0xf0}},
+		{"truncated offset", []byte{0x05, 0, 0, 0, 0x10, 'a', 0x01}},
+		{"zero offset", []byte{0x05, 0, 0, 0, 0x10, 'a', 0x00, 0x00}},
+		{"offset beyond output", []byte{0x05, 0, 0, 0, 0x10, 'a', 0x02, 0x00}},
+		{"truncated match length", []byte{0x20, 0, 0, 0, 0x1f, 'a', 0x01, 0x00}},
+		{"match beyond size", []byte{0x03, 0, 0, 0, 0x10, 'a', 0x01, 0x00}},
+		{"literals beyond size", []byte{0x01, 0, 0, 0, 0x20, 'a', 'b'}},
+		{"shorter than size", []byte{0x06, 0, 0, 0, 0x50, 'h', 'e', 'l', 'l', 'o'}},
+	}
+	for _, tt := range tests {
+		if _, err := (lz4Compressor{}).Decompress(tt.in, 0); err != errLZ4Corrupt {
+			t.Errorf("%s: expect corrupt block error, got %v", tt.name, err)
+		}
+	}
+	// a size beyond the limit fails before anything is allocated for it
+	if _, err := (lz4Compressor{}).Decompress([]byte{0xff, 0xff, 0xff, 0x7f, 0x00}, 1024); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expect too large error, got %v", err)
+	}
+}
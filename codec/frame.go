@@ -0,0 +1,197 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+)
+
+// FramedCodec writes every header and body as a frame, which is the
+// payload of Marshaler prefixed by its length as a big-endian uint32.
+// A body is dropped by skipping its frame, and a payload which can't
+// be decoded fails with DecodeError but leaves the connection usable.
+// The highest bit of the length is set if the payload is compressed.
+type FramedCodec struct {
+	conn      io.ReadWriteCloser
+	buf       *bufio.Writer
+	r         *bufio.Reader
+	m         Marshaler
+	comp      Compressor // compresses bodies, nil means no compression
+	threshold int        // bodies shorter than it are not compressed
+	maxHeader int        // limits of payloads, 0 means no limit
+	maxBody   int
+}
+
+var _ Codec = (*FramedCodec)(nil)
+var _ BatchWriter = (*FramedCodec)(nil)
+var _ Limiter = (*FramedCodec)(nil)
+
+// NewFramedCodec init framed codec which encodes payloads with m
+func NewFramedCodec(conn io.ReadWriteCloser, m Marshaler) Codec {
+	return &FramedCodec{
+		conn: conn,
+		buf:  bufio.NewWriter(conn),
+		r:    bufio.NewReader(conn),
+		m:    m,
+	}
+}
+
+// NewFramedCodecFunc returns the func which inits framed codecs of
+// the marshalers returned by f
+func NewFramedCodecFunc(f NewMarshalerFunc) NewCodecFunc {
+	return func(conn io.ReadWriteCloser) Codec {
+		return NewFramedCodec(conn, f())
+	}
+}
+
+// frameCompressed flags the length of a compressed frame
+const frameCompressed = 1 << 31
+
+// SetCompressor makes c compress the payloads of bodies of at least
+// threshold bytes with comp, which also decompresses the frames c reads
+func (c *FramedCodec) SetCompressor(comp Compressor, threshold int) {
+	c.comp, c.threshold = comp, threshold
+}
+
+// SetLimits makes c skip the frames whose payloads, or the payloads
+// they decompress to, are longer than the limits
+func (c *FramedCodec) SetLimits(maxHeader, maxBody int) {
+	c.maxHeader, c.maxBody = maxHeader, maxBody
+}
+
+// DecodeError is returned by FramedCodec if a frame is read but its
+// payload can't be decoded, the next frame can still be read
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// readFrame reads the payload of the next frame and whether it's
+// compressed, a payload longer than limit is skipped unread
+func (c *FramedCodec) readFrame(limit int) ([]byte, bool, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(c.r, n[:]); err != nil {
+		return nil, false, err
+	}
+	length := binary.BigEndian.Uint32(n[:])
+	compressed := length&frameCompressed != 0
+	size := int(length &^ frameCompressed)
+	if limit > 0 && size > limit {
+		if _, err := c.r.Discard(size); err != nil {
+			// the frame is cut short like a payload read by io.ReadFull
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, false, err
+		}
+		return nil, compressed, &DecodeError{Err: tooLarge(limit)}
+	}
+	b := make([]byte, size)
+	_, err := io.ReadFull(c.r, b)
+	return b, compressed, err
+}
+
+// readInto reads the next frame and decodes it into v
+func (c *FramedCodec) readInto(v interface{}, limit int) error {
+	b, compressed, err := c.readFrame(limit)
+	if err != nil {
+		// a frame which is dropped anyway is skipped quietly
+		var de *DecodeError
+		if v == nil && errors.As(err, &de) {
+			return nil
+		}
+		return err
+	}
+	// a dropped frame is never decoded
+	if v == nil {
+		return nil
+	}
+	if compressed {
+		if c.comp == nil {
+			return &DecodeError{Err: errors.New("rpc codec: compressed frame without compressor")}
+		}
+		if b, err = c.comp.Decompress(b, limit); err != nil {
+			return &DecodeError{Err: err}
+		}
+	}
+	if err = c.m.Unmarshal(b, v); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return nil
+}
+
+func (c *FramedCodec) ReadHeader(h *Header) error {
+	return c.readInto(h, c.maxHeader)
+}
+
+func (c *FramedCodec) ReadBody(body interface{}) error {
+	return c.readInto(body, c.maxBody)
+}
+
+func (c *FramedCodec) Write(h *Header, body interface{}) (err error) {
+	return c.WriteBatch(h, []interface{}{body})
+}
+
+// WriteBatch write msg to header and every body of the batch, then flush once
+func (c *FramedCodec) WriteBatch(h *Header, bodies []interface{}) (err error) {
+	// close connect
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	// the message is encoded before it's written, so that an
+	// unsupported body doesn't leave half of it on the connection
+	var out []byte
+	if out, err = c.appendFrame(out, h, false); err != nil {
+		log.Println("rpc codec: framed error encoding header:", err)
+		return err
+	}
+	for _, body := range bodies {
+		if out, err = c.appendFrame(out, body, true); err != nil {
+			log.Println("rpc codec: framed error encoding body:", err)
+			return err
+		}
+	}
+	_, err = c.buf.Write(out)
+	return err
+}
+
+// appendFrame appends the frame of v to b, the payload of a body is
+// compressed if it's long enough and compression makes it shorter
+func (c *FramedCodec) appendFrame(b []byte, v interface{}, body bool) ([]byte, error) {
+	payload, err := c.m.Marshal(v)
+	if err != nil {
+		return b, err
+	}
+	var flag uint32
+	if body && c.comp != nil && len(payload) >= c.threshold {
+		compressed, err := c.comp.Compress(payload)
+		if err != nil {
+			return b, err
+		}
+		if len(compressed) < len(payload) {
+			payload, flag = compressed, frameCompressed
+		}
+	}
+	if len(payload) >= frameCompressed {
+		return b, errors.New("rpc codec: frame too large")
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload))|flag)
+	return append(b, payload...), nil
+}
+
+func (c *FramedCodec) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,115 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// frame returns payload prefixed by its length and flag
+func frame(payload []byte, flag uint32) []byte {
+	n := uint32(len(payload)) | flag
+	return append([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, payload...)
+}
+
+func TestFramedCodec_Vector(t *testing.T) {
+	var b bytes.Buffer
+	cc := NewFramedCodec(bufConn{&b}, NewProtobufMarshaler())
+	if err := cc.Write(&Header{ServiceMethod: "A.B", Seq: 1}, int64(150)); err != nil {
+		t.Fatalf("expect written, got %v", err)
+	}
+	want := append(frame([]byte{0x0a, 0x03, 'A', '.', 'B', 0x10, 0x01}, 0), frame([]byte{0x08, 0x96, 0x01}, 0)...)
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("expect % x, got % x", want, b.Bytes())
+	}
+	var h Header
+	var n int64
+	if err := cc.ReadHeader(&h); err != nil || h.ServiceMethod != "A.B" || h.Seq != 1 {
+		t.Errorf("expect header read, got %+v, %v", h, err)
+	}
+	if err := cc.ReadBody(&n); err != nil || n != 150 {
+		t.Errorf("expect body read, got %d, %v", n, err)
+	}
+}
+
+func TestFramedCodec_Read(t *testing.T) {
+	next := frame([]byte(`7`), 0)
+	tests := []struct {
+		name   string
+		in     []byte
+		v      interface{}
+		limit  int
+		decode bool // the error is a DecodeError and the next frame is read
+		large  bool // the error is ErrTooLarge
+	}{
+		{"truncated length", []byte{0, 0}, new(int), 0, false, false},
+		{"truncated payload", []byte{0, 0, 0, 5, '1'}, new(int), 0, false, false},
+		{"truncated dropped", []byte{0, 0, 0, 5, '1'}, nil, 0, false, false},
+		{"malformed payload", frame([]byte(`"a`), 0), new(int), 0, true, false},
+		{"wrong type", frame([]byte(`"a"`), 0), new(int), 0, true, false},
+		{"no compressor", frame([]byte(`1`), frameCompressed), new(int), 0, true, false},
+		{"too large", frame([]byte(`12345`), 0), new(int), 4, true, true},
+		{"too large truncated", []byte{0, 0, 0, 5, '1'}, new(int), 4, false, false},
+	}
+	for _, tt := range tests {
+		in := tt.in
+		if tt.decode {
+			in = append(in, next...)
+		}
+		cc := NewFramedCodec(bufConn{bytes.NewBuffer(in)}, NewJsonMarshaler())
+		cc.(Limiter).SetLimits(0, tt.limit)
+		err := cc.ReadBody(tt.v)
+		var de *DecodeError
+		if errors.As(err, &de) != tt.decode || errors.Is(err, ErrTooLarge) != tt.large {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if !tt.decode {
+			if err != io.ErrUnexpectedEOF {
+				t.Errorf("%s: expect unexpected EOF, got %v", tt.name, err)
+			}
+			continue
+		}
+		var n int
+		if err = cc.ReadBody(&n); err != nil || n != 7 {
+			t.Errorf("%s: expect next frame read, got %d, %v", tt.name, n, err)
+		}
+	}
+}
+
+func TestFramedCodec_Skip(t *testing.T) {
+	type item struct{ Name string }
+	marshalers := map[string]NewMarshalerFunc{
+		"gob":      NewGobMarshaler,
+		"json":     NewJsonMarshaler,
+		"msgpack":  NewMsgpackMarshaler,
+		"protobuf": NewProtobufMarshaler,
+	}
+	for name, newMarshaler := range marshalers {
+		var b bytes.Buffer
+		cc := NewFramedCodec(bufConn{&b}, newMarshaler())
+		cc.(Limiter).SetLimits(0, 64)
+		_ = cc.Write(&Header{Seq: 1}, item{Name: "a"})
+		_ = cc.Write(&Header{Seq: 2}, item{Name: strings.Repeat("b", 100)})
+		_ = cc.Write(&Header{Seq: 3}, item{Name: "c"})
+
+		var h Header
+		var v item
+		// frames are skipped unread, dropped or too large
+		_ = cc.ReadHeader(&h)
+		if err := cc.ReadBody(nil); err != nil {
+			t.Errorf("%s: expect frame dropped, got %v", name, err)
+		}
+		_ = cc.ReadHeader(&h)
+		if err := cc.ReadBody(&v); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%s: expect too large error, got %v", name, err)
+		}
+		if err := cc.ReadHeader(&h); err != nil || h.Seq != 3 {
+			t.Errorf("%s: expect header after skipped frames, got %+v, %v", name, h, err)
+		}
+		if err := cc.ReadBody(&v); err != nil || v.Name != "c" {
+			t.Errorf("%s: expect body after skipped frames, got %+v, %v", name, v, err)
+		}
+	}
+}
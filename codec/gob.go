@@ -2,36 +2,54 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/gob"
+	"errors"
 	"io"
 	"log"
+	"math"
 )
 
 type GobCodec struct {
-	conn io.ReadWriteCloser
-	buf  *bufio.Writer
-	dec  *gob.Decoder
-	enc  *gob.Encoder
+	conn      io.ReadWriteCloser
+	buf       *bufio.Writer
+	r         *gobLimitReader
+	dec       *gob.Decoder
+	enc       *gob.Encoder
+	maxHeader int // limits of gob messages, 0 means no limit
+	maxBody   int
 }
 
 var _ Codec = (*GobCodec)(nil)
+var _ BatchWriter = (*GobCodec)(nil)
+var _ Limiter = (*GobCodec)(nil)
 
 // NewGobCodec init gob codec
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
 	buf := bufio.NewWriter(conn)
+	r := &gobLimitReader{r: bufio.NewReader(conn)}
 	return &GobCodec{
 		conn: conn,
 		buf:  buf,
-		dec:  gob.NewDecoder(conn),
+		r:    r,
+		dec:  gob.NewDecoder(r),
 		enc:  gob.NewEncoder(buf),
 	}
 }
 
+// SetLimits makes c fail before reading a gob message longer than the
+// limits, which also applies to the type definitions sent before a value
+func (c *GobCodec) SetLimits(maxHeader, maxBody int) {
+	c.maxHeader, c.maxBody = maxHeader, maxBody
+}
+
 func (c *GobCodec) ReadHeader(h *Header) error {
+	c.r.limit = c.maxHeader
 	return c.dec.Decode(h)
 }
 
 func (c *GobCodec) ReadBody(body interface{}) error {
+	c.r.limit = c.maxBody
 	return c.dec.Decode(body)
 }
 
@@ -59,6 +77,124 @@ func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
 	return nil
 }
 
+// WriteBatch write msg to header and every body of the batch, then flush once
+func (c *GobCodec) WriteBatch(h *Header, bodies []interface{}) (err error) {
+	// close connect
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	if err := c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: gob error encoding header:", err)
+		return err
+	}
+	for _, body := range bodies {
+		if err := c.enc.Encode(body); err != nil {
+			log.Println("rpc codec: gob error encoding body:", err)
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *GobCodec) Close() error {
 	return c.conn.Close()
 }
+
+// gobLimitReader reads a gob stream message by message, it checks the
+// count which prefixes each message before the message is read
+type gobLimitReader struct {
+	r     *bufio.Reader
+	limit int // longest message, 0 means no limit
+	left  int // bytes left of the current message, with its count
+}
+
+// next peeks the count of the next message once the current one is read
+func (l *gobLimitReader) next() error {
+	if l.left > 0 {
+		return nil
+	}
+	b, err := l.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	// a count below 128 is the byte itself, otherwise the byte is
+	// the negated length of the big-endian count which follows it
+	count, n := uint64(b[0]), 1
+	if b[0] >= 0x80 {
+		n += int(-int8(b[0]))
+		if n > 9 {
+			return errors.New("rpc codec: gob message count too long")
+		}
+		if b, err = l.r.Peek(n); err != nil {
+			return err
+		}
+		count = 0
+		for _, c := range b[1:] {
+			count = count<<8 | uint64(c)
+		}
+	}
+	if l.limit > 0 && count > uint64(l.limit) {
+		return tooLarge(l.limit)
+	}
+	if count > uint64(math.MaxInt-n) {
+		return errors.New("rpc codec: gob message count too large")
+	}
+	l.left = n + int(count)
+	return nil
+}
+
+func (l *gobLimitReader) Read(p []byte) (int, error) {
+	if err := l.next(); err != nil {
+		return 0, err
+	}
+	if len(p) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= n
+	return n, err
+}
+
+// ReadByte keeps gob from wrapping l in a reader which reads ahead
+func (l *gobLimitReader) ReadByte() (byte, error) {
+	if err := l.next(); err != nil {
+		return 0, err
+	}
+	b, err := l.r.ReadByte()
+	if err == nil {
+		l.left--
+	}
+	return b, err
+}
+
+// GobMarshaler encodes payloads of frames in gob, every payload is a
+// gob stream of its own which carries its types, so that any frame
+// can be skipped without decoding it
+type GobMarshaler struct{}
+
+var _ Marshaler = GobMarshaler{}
+
+// NewGobMarshaler init gob marshaler
+func NewGobMarshaler() Marshaler {
+	return GobMarshaler{}
+}
+
+func (GobMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (GobMarshaler) Unmarshal(data []byte, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	// bytes.Reader is an io.ByteReader, so gob doesn't copy it into a buffer
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
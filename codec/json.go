@@ -8,30 +8,62 @@ import (
 )
 
 type JsonCodec struct {
-	conn io.ReadWriteCloser
-	buf  *bufio.Writer
-	dec  *json.Decoder
-	enc  *json.Encoder
+	conn      io.ReadWriteCloser
+	buf       *bufio.Writer
+	r         *jsonLimitReader
+	dec       *json.Decoder
+	enc       *json.Encoder
+	maxHeader int // limits of values, 0 means no limit
+	maxBody   int
 }
 
 var _ Codec = (*GobCodec)(nil)
+var _ BatchWriter = (*JsonCodec)(nil)
+var _ Limiter = (*JsonCodec)(nil)
 
 // NewJsonCodec init json codec
 func NewJsonCodec(conn io.ReadWriteCloser) Codec {
 	buf := bufio.NewWriter(conn)
+	r := &jsonLimitReader{r: conn}
 	return &JsonCodec{
 		conn: conn,
 		buf:  buf,
-		dec:  json.NewDecoder(conn),
+		r:    r,
+		dec:  json.NewDecoder(r),
 		enc:  json.NewEncoder(buf),
 	}
 }
 
+// SetLimits makes c fail once it has to read more than the limits
+// to decode a value, the newlines around values are not counted
+func (c *JsonCodec) SetLimits(maxHeader, maxBody int) {
+	c.maxHeader, c.maxBody = maxHeader, maxBody
+}
+
+// jsonSpace is the newline before and after a value written by json.Encoder
+const jsonSpace = 2
+
+// limit bounds the bytes read to decode the next value
+func (c *JsonCodec) limit(limit int) {
+	c.r.max = 0
+	if limit > 0 {
+		c.r.max = c.dec.InputOffset() + int64(limit) + jsonSpace
+		c.r.err = tooLarge(limit)
+	}
+}
+
 func (c *JsonCodec) ReadHeader(h *Header) error {
+	c.limit(c.maxHeader)
 	return c.dec.Decode(h)
 }
 
 func (c *JsonCodec) ReadBody(body interface{}) error {
+	c.limit(c.maxBody)
+	// json can't decode into nil, discard the body instead
+	if body == nil {
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
 	return c.dec.Decode(body)
 }
 
@@ -59,6 +91,73 @@ func (c *JsonCodec) Write(h *Header, body interface{}) (err error) {
 	return nil
 }
 
+// WriteBatch write msg to header and every body of the batch, then flush once
+func (c *JsonCodec) WriteBatch(h *Header, bodies []interface{}) (err error) {
+	// close connect
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	if err := c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: json error encoding header:", err)
+		return err
+	}
+	for _, body := range bodies {
+		if err := c.enc.Encode(body); err != nil {
+			log.Println("rpc codec: json error encoding body:", err)
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *JsonCodec) Close() error {
 	return c.conn.Close()
 }
+
+// jsonLimitReader fails with err once r is read up to max bytes
+type jsonLimitReader struct {
+	r   io.Reader
+	n   int64 // bytes read from r
+	max int64 // 0 means no limit
+	err error
+}
+
+func (l *jsonLimitReader) Read(p []byte) (int, error) {
+	if l.max > 0 {
+		left := l.max - l.n
+		if left <= 0 {
+			return 0, l.err
+		}
+		if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// JsonMarshaler encodes payloads of frames in json
+type JsonMarshaler struct{}
+
+var _ Marshaler = JsonMarshaler{}
+
+// NewJsonMarshaler init json marshaler
+func NewJsonMarshaler() Marshaler {
+	return JsonMarshaler{}
+}
+
+func (JsonMarshaler) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JsonMarshaler) Unmarshal(data []byte, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
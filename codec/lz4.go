@@ -0,0 +1,156 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// lz4Compressor writes the LZ4 block format prefixed by the size of
+// source as a little-endian uint32, like lz4.block of Python does
+type lz4Compressor struct{}
+
+const (
+	lz4MinMatch  = 4
+	lz4LastLits  = 5  // the last bytes of a block are always literals
+	lz4MatchEnd  = 12 // the last match starts before this many bytes from the end
+	lz4MaxOffset = 1<<16 - 1
+	lz4HashLog   = 14
+)
+
+var errLZ4Corrupt = errors.New("lz4: corrupt block")
+
+func lz4Hash(v uint32) uint32 {
+	return v * 2654435761 >> (32 - lz4HashLog)
+}
+
+func (lz4Compressor) Compress(src []byte) ([]byte, error) {
+	dst := make([]byte, 4, 4+len(src)+len(src)/255+16)
+	binary.LittleEndian.PutUint32(dst, uint32(len(src)))
+
+	// positions of the last 4 bytes of each hash, plus 1
+	var table [1 << lz4HashLog]int32
+	anchor := 0
+	for i := 0; i < len(src)-lz4MatchEnd; {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(v)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != v {
+			i++
+			continue
+		}
+		n := lz4MinMatch
+		for i+n < len(src)-lz4LastLits && src[ref+n] == src[i+n] {
+			n++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0), nil
+}
+
+// lz4AppendSequence appends literals followed by a match of n bytes
+// at offset, the last sequence has no match
+func lz4AppendSequence(dst, literals []byte, offset, n int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if n > 0 {
+		token |= byte(min(n-lz4MinMatch, 15))
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if n == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if n-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, n-lz4MinMatch-15)
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+func lz4ReadLength(src []byte) (int, []byte, error) {
+	n := 0
+	for {
+		if len(src) == 0 {
+			return 0, nil, errLZ4Corrupt
+		}
+		b := src[0]
+		src = src[1:]
+		n += int(b)
+		if b != 255 {
+			return n, src, nil
+		}
+	}
+}
+
+func (lz4Compressor) Decompress(src []byte, limit int) ([]byte, error) {
+	if len(src) < 4 {
+		return nil, errLZ4Corrupt
+	}
+	size := int(binary.LittleEndian.Uint32(src))
+	if limit > 0 && size > limit {
+		return nil, tooLarge(limit)
+	}
+	src = src[4:]
+	// a block can't expand more than 255 times, don't trust size beyond it
+	dst := make([]byte, 0, min(size, len(src)*255))
+	var err error
+	for len(src) > 0 {
+		token := src[0]
+		src = src[1:]
+		n := int(token >> 4)
+		if n == 15 {
+			var more int
+			if more, src, err = lz4ReadLength(src); err != nil {
+				return nil, err
+			}
+			n += more
+		}
+		if n > len(src) || len(dst)+n > size {
+			return nil, errLZ4Corrupt
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+		if len(src) == 0 {
+			break
+		}
+
+		if len(src) < 2 {
+			return nil, errLZ4Corrupt
+		}
+		offset := int(src[0]) | int(src[1])<<8
+		src = src[2:]
+		n = int(token & 15)
+		if n == 15 {
+			var more int
+			if more, src, err = lz4ReadLength(src); err != nil {
+				return nil, err
+			}
+			n += more
+		}
+		n += lz4MinMatch
+		if offset == 0 || offset > len(dst) || len(dst)+n > size {
+			return nil, errLZ4Corrupt
+		}
+		// the match may overlap the bytes it produces
+		start := len(dst) - offset
+		for i := 0; i < n; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if len(dst) != size {
+		return nil, errLZ4Corrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,1154 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MsgpackCodec encodes headers and bodies in MessagePack, structs are
+// maps keyed by field name, which is overridden by the msgpack tag, eg
+//
+//	Name  string `msgpack:"name"`
+//	Email string `msgpack:"email,omitempty"`
+//	Token string `msgpack:"-"`
+//
+// time.Time is the timestamp extension type -1 and []byte is bin.
+type MsgpackCodec struct {
+	conn      io.ReadWriteCloser
+	buf       *bufio.Writer
+	r         *msgpackLimitReader
+	dec       *msgpackDecoder
+	enc       *msgpackEncoder
+	maxHeader int // limits of values, 0 means no limit
+	maxBody   int
+}
+
+var _ Codec = (*MsgpackCodec)(nil)
+var _ BatchWriter = (*MsgpackCodec)(nil)
+var _ Limiter = (*MsgpackCodec)(nil)
+
+// NewMsgpackCodec init msgpack codec
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	r := &msgpackLimitReader{r: bufio.NewReader(conn)}
+	return &MsgpackCodec{
+		conn: conn,
+		buf:  bufio.NewWriter(conn),
+		r:    r,
+		dec:  &msgpackDecoder{r: r},
+		enc:  new(msgpackEncoder),
+	}
+}
+
+// SetLimits makes c fail once a value is longer than the limits,
+// lengths beyond them fail before anything is allocated for them
+func (c *MsgpackCodec) SetLimits(maxHeader, maxBody int) {
+	c.maxHeader, c.maxBody = maxHeader, maxBody
+}
+
+func (c *MsgpackCodec) ReadHeader(h *Header) error {
+	c.r.limit, c.r.left = c.maxHeader, c.maxHeader
+	return c.dec.Decode(h)
+}
+
+func (c *MsgpackCodec) ReadBody(body interface{}) error {
+	c.r.limit, c.r.left = c.maxBody, c.maxBody
+	return c.dec.Decode(body)
+}
+
+func (c *MsgpackCodec) Write(h *Header, body interface{}) (err error) {
+	return c.WriteBatch(h, []interface{}{body})
+}
+
+// WriteBatch write msg to header and every body of the batch, then flush once
+func (c *MsgpackCodec) WriteBatch(h *Header, bodies []interface{}) (err error) {
+	// close connect
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	// the message is encoded before it's written, so that an
+	// unsupported body doesn't leave half of it on the connection
+	c.enc.buf = c.enc.buf[:0]
+	if err := c.enc.encode(reflect.ValueOf(h)); err != nil {
+		log.Println("rpc codec: msgpack error encoding header:", err)
+		return err
+	}
+	for _, body := range bodies {
+		if err := c.enc.encode(reflect.ValueOf(body)); err != nil {
+			log.Println("rpc codec: msgpack error encoding body:", err)
+			return err
+		}
+	}
+	_, err = c.buf.Write(c.enc.buf)
+	return err
+}
+
+func (c *MsgpackCodec) Close() error {
+	return c.conn.Close()
+}
+
+// formats of msgpack
+const (
+	mpNil      = 0xc0
+	mpFalse    = 0xc2
+	mpTrue     = 0xc3
+	mpBin8     = 0xc4
+	mpBin16    = 0xc5
+	mpBin32    = 0xc6
+	mpExt8     = 0xc7
+	mpExt16    = 0xc8
+	mpExt32    = 0xc9
+	mpFloat32  = 0xca
+	mpFloat64  = 0xcb
+	mpUint8    = 0xcc
+	mpUint16   = 0xcd
+	mpUint32   = 0xce
+	mpUint64   = 0xcf
+	mpInt8     = 0xd0
+	mpInt16    = 0xd1
+	mpInt32    = 0xd2
+	mpInt64    = 0xd3
+	mpFixExt1  = 0xd4
+	mpFixExt4  = 0xd6
+	mpFixExt8  = 0xd7
+	mpFixExt16 = 0xd8
+	mpStr8     = 0xd9
+	mpStr16    = 0xda
+	mpStr32    = 0xdb
+	mpArray16  = 0xdc
+	mpArray32  = 0xdd
+	mpMap16    = 0xde
+	mpMap32    = 0xdf
+
+	mpTimeExt = -1 // extension type of timestamps
+)
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	byteSliceType = reflect.TypeOf([]byte(nil))
+)
+
+// msgpackField is a field of struct encoded as a map entry
+type msgpackField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// msgpackFields caches the fields of struct types
+var msgpackFields sync.Map
+
+// fieldsOf returns the encoded fields of struct type t, fields of
+// embedded structs are promoted unless a field of t has the same name
+func fieldsOf(t reflect.Type) []msgpackField {
+	if f, ok := msgpackFields.Load(t); ok {
+		return f.([]msgpackField)
+	}
+	var fields, embedded []msgpackField
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("msgpack")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range fieldsOf(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				embedded = append(embedded, f)
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		names[name] = true
+		fields = append(fields, msgpackField{name: name, index: []int{i}, omitEmpty: opts == "omitempty"})
+	}
+	for _, f := range embedded {
+		if !names[f.name] {
+			names[f.name] = true
+			fields = append(fields, f)
+		}
+	}
+	msgpackFields.Store(t, fields)
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return v.Interface().(time.Time).IsZero()
+		}
+	}
+	return false
+}
+
+// msgpackEncoder appends the encoding of values to buf
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) byte1(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *msgpackEncoder) uint16(c byte, n uint16) {
+	e.buf = binary.BigEndian.AppendUint16(append(e.buf, c), n)
+}
+
+func (e *msgpackEncoder) uint32(c byte, n uint32) {
+	e.buf = binary.BigEndian.AppendUint32(append(e.buf, c), n)
+}
+
+func (e *msgpackEncoder) uint64(c byte, n uint64) {
+	e.buf = binary.BigEndian.AppendUint64(append(e.buf, c), n)
+}
+
+// length writes the header of str, bin, array and map of n elements,
+// fix is the fix format, or 0 if there is none
+func (e *msgpackEncoder) length(n int, fix, fixMax, c8, c16, c32 byte) {
+	switch {
+	case fix != 0 && n <= int(fixMax):
+		e.byte1(fix | byte(n))
+	case c8 != 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, c8, byte(n))
+	case n <= math.MaxUint16:
+		e.uint16(c16, uint16(n))
+	default:
+		e.uint32(c32, uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) int(n int64) {
+	switch {
+	case n >= 0:
+		e.uint(uint64(n))
+	case n >= -32:
+		e.byte1(byte(n))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, mpInt8, byte(n))
+	case n >= math.MinInt16:
+		e.uint16(mpInt16, uint16(n))
+	case n >= math.MinInt32:
+		e.uint32(mpInt32, uint32(n))
+	default:
+		e.uint64(mpInt64, uint64(n))
+	}
+}
+
+func (e *msgpackEncoder) uint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.byte1(byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, mpUint8, byte(n))
+	case n <= math.MaxUint16:
+		e.uint16(mpUint16, uint16(n))
+	case n <= math.MaxUint32:
+		e.uint32(mpUint32, uint32(n))
+	default:
+		e.uint64(mpUint64, n)
+	}
+}
+
+func (e *msgpackEncoder) string(s string) {
+	e.length(len(s), 0xa0, 31, mpStr8, mpStr16, mpStr32)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) bytes(b []byte) {
+	e.length(len(b), 0, 0, mpBin8, mpBin16, mpBin32)
+	e.buf = append(e.buf, b...)
+}
+
+// time writes t in the smallest timestamp format which holds it
+func (e *msgpackEncoder) time(t time.Time) {
+	sec, nsec := t.Unix(), uint64(t.Nanosecond())
+	if sec>>34 == 0 {
+		data := nsec<<34 | uint64(sec)
+		if data>>32 == 0 {
+			e.buf = append(e.buf, mpFixExt4, byte(0xff))
+			e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(data))
+		} else {
+			e.buf = append(e.buf, mpFixExt8, byte(0xff))
+			e.buf = binary.BigEndian.AppendUint64(e.buf, data)
+		}
+		return
+	}
+	e.buf = append(e.buf, mpExt8, 12, byte(0xff))
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(nsec))
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(sec))
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.byte1(mpNil)
+		return nil
+	}
+	if v.Type() == timeType {
+		e.time(v.Interface().(time.Time))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.byte1(mpNil)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.byte1(mpTrue)
+		} else {
+			e.byte1(mpFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.uint(v.Uint())
+	case reflect.Float32:
+		e.uint32(mpFloat32, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.uint64(mpFloat64, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.string(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.byte1(mpNil)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.bytes(v.Bytes())
+			return nil
+		}
+		return e.array(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.bytes(b)
+			return nil
+		}
+		return e.array(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.byte1(mpNil)
+			return nil
+		}
+		e.length(v.Len(), 0x80, 15, 0, mpMap16, mpMap32)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := fieldsOf(v.Type())
+		n := 0
+		for _, f := range fields {
+			if !f.omitEmpty || !isEmptyValue(v.FieldByIndex(f.index)) {
+				n++
+			}
+		}
+		e.length(n, 0x80, 15, 0, mpMap16, mpMap32)
+		for _, f := range fields {
+			fv := v.FieldByIndex(f.index)
+			if f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			e.string(f.name)
+			if err := e.encode(fv); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) array(v reflect.Value) error {
+	e.length(v.Len(), 0x90, 15, 0, mpArray16, mpArray32)
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// msgpackDecoder reads values from r, a value which doesn't fit its
+// destination is skipped, so that the next one can still be read
+type msgpackDecoder struct {
+	r     byteReader
+	err   error // first value which doesn't fit its destination
+	depth int   // nesting of the value being read
+}
+
+// byteReader is read by msgpackDecoder, such as a bufio.Reader of
+// the connection or a bytes.Reader of a frame
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// msgpackLimitReader fails once more than limit bytes of a value are read
+type msgpackLimitReader struct {
+	r     *bufio.Reader
+	limit int // 0 means no limit
+	left  int // bytes left to read of the value
+}
+
+func (l *msgpackLimitReader) Read(p []byte) (int, error) {
+	if l.limit > 0 {
+		if l.left <= 0 && len(p) > 0 {
+			return 0, tooLarge(l.limit)
+		}
+		p = p[:min(len(p), l.left)]
+	}
+	n, err := l.r.Read(p)
+	l.left -= n
+	return n, err
+}
+
+func (l *msgpackLimitReader) ReadByte() (byte, error) {
+	if l.limit > 0 && l.left <= 0 {
+		return 0, tooLarge(l.limit)
+	}
+	b, err := l.r.ReadByte()
+	if err == nil {
+		l.left--
+	}
+	return b, err
+}
+
+// fits fails if n bytes, or elements of at least a byte each, can't
+// follow in what is left to read, so that a corrupt length doesn't
+// allocate more than the value can hold
+func (d *msgpackDecoder) fits(n int) error {
+	switch r := d.r.(type) {
+	case *msgpackLimitReader:
+		if r.limit > 0 && n > r.left {
+			return tooLarge(r.limit)
+		}
+	case *bytes.Reader:
+		if n > r.Len() {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) discard(n int) error {
+	_, err := io.CopyN(io.Discard, d.r, int64(n))
+	return err
+}
+
+// Decode reads the next value into v, which must be a pointer,
+// or skips it if v is nil
+func (d *msgpackDecoder) Decode(v interface{}) error {
+	d.err, d.depth = nil, 0
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return d.skip(c)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		if err = d.skip(c); err != nil {
+			return err
+		}
+		return fmt.Errorf("msgpack: decode into non-pointer %T", v)
+	}
+	if err = d.decode(c, rv.Elem()); err != nil {
+		return err
+	}
+	return d.err
+}
+
+// mismatch skips the value of format c which doesn't fit type t
+func (d *msgpackDecoder) mismatch(c byte, t reflect.Type) error {
+	if err := d.skip(c); err != nil {
+		return err
+	}
+	if d.err == nil {
+		d.err = fmt.Errorf("msgpack: cannot decode %s into %s", formatName(c), t)
+	}
+	return nil
+}
+
+func formatName(c byte) string {
+	switch {
+	case c <= 0x7f || c >= 0xe0 || c >= mpUint8 && c <= mpInt64:
+		return "integer"
+	case c <= 0x8f || c == mpMap16 || c == mpMap32:
+		return "map"
+	case c <= 0x9f || c == mpArray16 || c == mpArray32:
+		return "array"
+	case c <= 0xbf || c >= mpStr8 && c <= mpStr32:
+		return "string"
+	case c == mpNil:
+		return "nil"
+	case c == mpFalse || c == mpTrue:
+		return "bool"
+	case c >= mpBin8 && c <= mpBin32:
+		return "bin"
+	case c == mpFloat32 || c == mpFloat64:
+		return "float"
+	}
+	return "ext"
+}
+
+// read reads n bytes, which may be more than what is left to read
+// if the reader has no limit
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	return readFull(d.r, n)
+}
+
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, x := range b {
+		u = u<<8 | uint64(x)
+	}
+	return u, nil
+}
+
+// length reads the length of str, bin, array, map or ext of format
+// c, and for ext its type, ok is false if c is none of them
+func (d *msgpackDecoder) length(c byte) (n int, ext int8, ok bool, err error) {
+	var u uint64
+	switch {
+	case c >= 0x80 && c <= 0x8f:
+		return int(c & 0x0f), 0, true, nil
+	case c >= 0x90 && c <= 0x9f:
+		return int(c & 0x0f), 0, true, nil
+	case c >= 0xa0 && c <= 0xbf:
+		return int(c & 0x1f), 0, true, nil
+	case c == mpBin8 || c == mpStr8 || c == mpExt8:
+		u, err = d.uint(1)
+	case c == mpBin16 || c == mpStr16 || c == mpExt16 || c == mpArray16 || c == mpMap16:
+		u, err = d.uint(2)
+	case c == mpBin32 || c == mpStr32 || c == mpExt32 || c == mpArray32 || c == mpMap32:
+		u, err = d.uint(4)
+	case c >= mpFixExt1 && c <= mpFixExt16:
+		u = 1 << (c - mpFixExt1)
+	default:
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if c >= mpExt8 && c <= mpExt32 || c >= mpFixExt1 && c <= mpFixExt16 {
+		t, err := d.r.ReadByte()
+		if err != nil {
+			return 0, 0, false, err
+		}
+		ext = int8(t)
+	}
+	if err = d.fits(int(u)); err != nil {
+		return 0, 0, false, err
+	}
+	return int(u), ext, true, nil
+}
+
+// skip reads and drops the rest of the value of format c
+func (d *msgpackDecoder) skip(c byte) error {
+	if d.depth++; d.depth > maxDepth {
+		return errTooDeep
+	}
+	defer func() { d.depth-- }()
+	switch {
+	case c <= 0x7f || c >= 0xe0 || c == mpNil || c == mpFalse || c == mpTrue:
+		return nil
+	case c == mpFloat32:
+		return d.discard(4)
+	case c == mpFloat64:
+		return d.discard(8)
+	case c >= mpUint8 && c <= mpUint64:
+		return d.discard(1 << (c - mpUint8))
+	case c >= mpInt8 && c <= mpInt64:
+		return d.discard(1 << (c - mpInt8))
+	}
+	n, _, ok, err := d.length(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("msgpack: invalid format %#x", c)
+	}
+	switch {
+	case c <= 0x8f || c == mpMap16 || c == mpMap32:
+		n *= 2
+	case c <= 0x9f || c == mpArray16 || c == mpArray32:
+	default:
+		return d.discard(n)
+	}
+	for i := 0; i < n; i++ {
+		if err = d.skipNext(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) skipNext() error {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	return d.skip(c)
+}
+
+// integer reads the integer of format c, neg is true if it's negative
+func (d *msgpackDecoder) integer(c byte) (u uint64, neg bool, ok bool, err error) {
+	switch {
+	case c <= 0x7f:
+		return uint64(c), false, true, nil
+	case c >= 0xe0:
+		return uint64(int64(int8(c))), true, true, nil
+	case c >= mpUint8 && c <= mpUint64:
+		u, err = d.uint(1 << (c - mpUint8))
+		return u, false, true, err
+	case c >= mpInt8 && c <= mpInt64:
+		n := 1 << (c - mpInt8)
+		u, err = d.uint(n)
+		// sign extend
+		shift := 64 - 8*n
+		i := int64(u<<shift) >> shift
+		return uint64(i), i < 0, true, err
+	}
+	return 0, false, false, nil
+}
+
+func (d *msgpackDecoder) float(c byte) (float64, error) {
+	if c == mpFloat32 {
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	}
+	u, err := d.uint(8)
+	return math.Float64frombits(u), err
+}
+
+func isStr(c byte) bool {
+	return c >= 0xa0 && c <= 0xbf || c >= mpStr8 && c <= mpStr32
+}
+
+func isBin(c byte) bool {
+	return c >= mpBin8 && c <= mpBin32
+}
+
+func isArray(c byte) bool {
+	return c >= 0x90 && c <= 0x9f || c == mpArray16 || c == mpArray32
+}
+
+func isMap(c byte) bool {
+	return c >= 0x80 && c <= 0x8f || c == mpMap16 || c == mpMap32
+}
+
+func isExt(c byte) bool {
+	return c >= mpExt8 && c <= mpExt32 || c >= mpFixExt1 && c <= mpFixExt16
+}
+
+// timestamp reads the payload of the timestamp extension of n bytes
+func (d *msgpackDecoder) timestamp(n int) (time.Time, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), 0), nil
+	case 8:
+		data := binary.BigEndian.Uint64(b)
+		return time.Unix(int64(data&(1<<34-1)), int64(data>>34)), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(b)
+		sec := binary.BigEndian.Uint64(b[4:])
+		return time.Unix(int64(sec), int64(nsec)), nil
+	}
+	return time.Time{}, fmt.Errorf("msgpack: invalid timestamp of %d bytes", n)
+}
+
+// decode reads the rest of the value of format c into v
+func (d *msgpackDecoder) decode(c byte, v reflect.Value) error {
+	if d.depth++; d.depth > maxDepth {
+		return errTooDeep
+	}
+	defer func() { d.depth-- }()
+	if c == mpNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	t := v.Type()
+	switch {
+	case t == timeType:
+		return d.decodeTime(c, v)
+	case t.Kind() == reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return d.decode(c, v.Elem())
+	case t.Kind() == reflect.Interface:
+		if t.NumMethod() != 0 {
+			return d.mismatch(c, t)
+		}
+		x, err := d.decodeInterface(c)
+		if err != nil || x == nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(x))
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if c != mpFalse && c != mpTrue {
+			return d.mismatch(c, t)
+		}
+		v.SetBool(c == mpTrue)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		u, neg, ok, err := d.integer(c)
+		if !ok {
+			return d.mismatch(c, t)
+		}
+		if err != nil {
+			return err
+		}
+		if !neg && u > math.MaxInt64 || v.OverflowInt(int64(u)) {
+			return d.overflow(u, neg, t)
+		}
+		v.SetInt(int64(u))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, neg, ok, err := d.integer(c)
+		if !ok {
+			return d.mismatch(c, t)
+		}
+		if err != nil {
+			return err
+		}
+		if neg || v.OverflowUint(u) {
+			return d.overflow(u, neg, t)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		if c == mpFloat32 || c == mpFloat64 {
+			f, err := d.float(c)
+			if err != nil {
+				return err
+			}
+			v.SetFloat(f)
+			return nil
+		}
+		u, neg, ok, err := d.integer(c)
+		if !ok {
+			return d.mismatch(c, t)
+		}
+		if neg {
+			v.SetFloat(float64(int64(u)))
+		} else {
+			v.SetFloat(float64(u))
+		}
+		return err
+	case reflect.String:
+		if !isStr(c) && !isBin(c) {
+			return d.mismatch(c, t)
+		}
+		b, err := d.raw(c)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 && (isBin(c) || isStr(c)) {
+			b, err := d.raw(c)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(b)
+			return nil
+		}
+		if !isArray(c) {
+			return d.mismatch(c, t)
+		}
+		n, _, _, err := d.length(c)
+		if err != nil {
+			return err
+		}
+		return d.decodeSlice(n, v)
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && (isBin(c) || isStr(c)) {
+			b, err := d.raw(c)
+			if err != nil {
+				return err
+			}
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		if !isArray(c) {
+			return d.mismatch(c, t)
+		}
+		n, _, _, err := d.length(c)
+		if err != nil {
+			return err
+		}
+		return d.decodeElems(n, v)
+	case reflect.Map:
+		if !isMap(c) {
+			return d.mismatch(c, t)
+		}
+		n, _, _, err := d.length(c)
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(t))
+		}
+		for i := 0; i < n; i++ {
+			key := reflect.New(t.Key()).Elem()
+			if err = d.decodeNext(key); err != nil {
+				return err
+			}
+			elem := reflect.New(t.Elem()).Elem()
+			if err = d.decodeNext(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Struct:
+		if !isMap(c) {
+			return d.mismatch(c, t)
+		}
+		return d.decodeStruct(c, v)
+	default:
+		return d.mismatch(c, t)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeNext(v reflect.Value) error {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	return d.decode(c, v)
+}
+
+func (d *msgpackDecoder) overflow(u uint64, neg bool, t reflect.Type) error {
+	if d.err == nil {
+		if neg {
+			d.err = fmt.Errorf("msgpack: %d overflows %s", int64(u), t)
+		} else {
+			d.err = fmt.Errorf("msgpack: %d overflows %s", u, t)
+		}
+	}
+	return nil
+}
+
+// raw reads the bytes of str or bin of format c
+func (d *msgpackDecoder) raw(c byte) ([]byte, error) {
+	n, _, _, err := d.length(c)
+	if err != nil {
+		return nil, err
+	}
+	return d.read(n)
+}
+
+// maxPrealloc bounds the elements allocated before they're read, a
+// length is only checked against the bytes left, while elements may be
+// much larger than a byte
+const maxPrealloc = 1024
+
+// decodeSlice reads n elements into slice v, which grows as they're read
+func (d *msgpackDecoder) decodeSlice(n int, v reflect.Value) error {
+	t := v.Type()
+	v.Set(reflect.MakeSlice(t, 0, min(n, maxPrealloc)))
+	zero := reflect.Zero(t.Elem())
+	for i := 0; i < n; i++ {
+		v.Set(reflect.Append(v, zero))
+		if err := d.decodeNext(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeElems reads n elements into array v, elements
+// which don't fit in an array are dropped
+func (d *msgpackDecoder) decodeElems(n int, v reflect.Value) error {
+	for i := 0; i < n; i++ {
+		var err error
+		if i < v.Len() {
+			err = d.decodeNext(v.Index(i))
+		} else {
+			err = d.skipNext()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeStruct(c byte, v reflect.Value) error {
+	n, _, _, err := d.length(c)
+	if err != nil {
+		return err
+	}
+	fields := fieldsOf(v.Type())
+	for i := 0; i < n; i++ {
+		kc, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		// unknown fields and keys which aren't strings are dropped
+		if !isStr(kc) {
+			if err = d.skip(kc); err != nil {
+				return err
+			}
+			if err = d.skipNext(); err != nil {
+				return err
+			}
+			continue
+		}
+		key, err := d.raw(kc)
+		if err != nil {
+			return err
+		}
+		f := findField(fields, string(key))
+		if f == nil {
+			err = d.skipNext()
+		} else {
+			err = d.decodeNext(v.FieldByIndex(f.index))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findField prefers the field named key, then the one which
+// matches key case-insensitively
+func findField(fields []msgpackField, key string) *msgpackField {
+	var fold *msgpackField
+	for i := range fields {
+		if fields[i].name == key {
+			return &fields[i]
+		}
+		if fold == nil && strings.EqualFold(fields[i].name, key) {
+			fold = &fields[i]
+		}
+	}
+	return fold
+}
+
+func (d *msgpackDecoder) decodeTime(c byte, v reflect.Value) error {
+	if isStr(c) {
+		b, err := d.raw(c)
+		if err != nil {
+			return err
+		}
+		t, err := time.Parse(time.RFC3339Nano, string(b))
+		if err != nil && d.err == nil {
+			d.err = fmt.Errorf("msgpack: %w", err)
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if !isExt(c) {
+		return d.mismatch(c, timeType)
+	}
+	n, ext, _, err := d.length(c)
+	if err != nil {
+		return err
+	}
+	if ext != mpTimeExt {
+		if err = d.discard(n); err != nil {
+			return err
+		}
+		if d.err == nil {
+			d.err = fmt.Errorf("msgpack: cannot decode ext %d into %s", ext, timeType)
+		}
+		return nil
+	}
+	t, err := d.timestamp(n)
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(t))
+	return nil
+}
+
+// errUnhashable is the error of a map key which can't be an interface map key
+var errUnhashable = errors.New("msgpack: unhashable map key")
+
+// decodeInterface reads the rest of the value of format c as
+// nil, bool, int64, uint64, float32, float64, string, []byte,
+// time.Time, []interface{}, map[string]interface{} or, if some
+// keys aren't strings, map[interface{}]interface{}
+func (d *msgpackDecoder) decodeInterface(c byte) (interface{}, error) {
+	switch {
+	case c == mpNil:
+		return nil, nil
+	case c == mpFalse || c == mpTrue:
+		return c == mpTrue, nil
+	case c == mpFloat32:
+		f, err := d.float(c)
+		return float32(f), err
+	case c == mpFloat64:
+		return d.float(c)
+	case isStr(c):
+		b, err := d.raw(c)
+		return string(b), err
+	case isBin(c):
+		return d.raw(c)
+	case isExt(c):
+		var t time.Time
+		err := d.decodeTime(c, reflect.ValueOf(&t).Elem())
+		return t, err
+	case isArray(c):
+		n, _, _, err := d.length(c)
+		if err != nil {
+			return nil, err
+		}
+		var s []interface{}
+		err = d.decodeSlice(n, reflect.ValueOf(&s).Elem())
+		return s, err
+	case isMap(c):
+		return d.decodeInterfaceMap(c)
+	}
+	u, neg, ok, err := d.integer(c)
+	if !ok {
+		return nil, fmt.Errorf("msgpack: invalid format %#x", c)
+	}
+	if neg || c <= 0x7f || c >= mpInt8 && c <= mpInt64 {
+		return int64(u), err
+	}
+	return u, err
+}
+
+func (d *msgpackDecoder) decodeInterfaceMap(c byte) (interface{}, error) {
+	// elements of arrays are nested by decode, values of maps here
+	if d.depth++; d.depth > maxDepth {
+		return nil, errTooDeep
+	}
+	defer func() { d.depth-- }()
+	n, _, _, err := d.length(c)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]interface{}, 0, min(n, maxPrealloc))
+	values := make([]interface{}, 0, min(n, maxPrealloc))
+	strKeys := true
+	for i := 0; i < n; i++ {
+		kc, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		k, err := d.decodeInterface(kc)
+		if err != nil {
+			return nil, err
+		}
+		vc, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		val, err := d.decodeInterface(vc)
+		if err != nil {
+			return nil, err
+		}
+		keys, values = append(keys, k), append(values, val)
+		_, ok := k.(string)
+		strKeys = strKeys && ok
+	}
+	if strKeys {
+		m := make(map[string]interface{}, n)
+		for i, k := range keys {
+			m[k.(string)] = values[i]
+		}
+		return m, nil
+	}
+	m := make(map[interface{}]interface{}, n)
+	for i, k := range keys {
+		if k != nil && !reflect.TypeOf(k).Comparable() {
+			if d.err == nil {
+				d.err = errUnhashable
+			}
+			continue
+		}
+		m[k] = values[i]
+	}
+	return m, nil
+}
+
+// MsgpackMarshaler encodes payloads of frames in msgpack
+type MsgpackMarshaler struct {
+	enc msgpackEncoder
+	in  bytes.Reader
+	dec msgpackDecoder
+}
+
+var _ Marshaler = (*MsgpackMarshaler)(nil)
+
+// NewMsgpackMarshaler init msgpack marshaler
+func NewMsgpackMarshaler() Marshaler {
+	m := new(MsgpackMarshaler)
+	m.dec.r = &m.in
+	return m
+}
+
+func (m *MsgpackMarshaler) Marshal(v interface{}) ([]byte, error) {
+	m.enc.buf = m.enc.buf[:0]
+	if err := m.enc.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return m.enc.buf, nil
+}
+
+func (m *MsgpackMarshaler) Unmarshal(data []byte, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	m.in.Reset(data)
+	return m.dec.Decode(v)
+}
@@ -0,0 +1,263 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bufConn is a connection which reads what is written to it
+type bufConn struct {
+	*bytes.Buffer
+}
+
+func (bufConn) Close() error { return nil }
+
+func TestMsgpack_MaxDepth(t *testing.T) {
+	type plain struct{ Name string }
+	arrays := bytes.Repeat([]byte{0x91}, maxDepth+1)          // arrays of one array
+	maps := bytes.Repeat([]byte{0x81, 0xa1, 'k'}, maxDepth+1) // maps of one map
+	tests := []struct {
+		name string
+		in   []byte
+		v    interface{}
+	}{
+		{"skipped", arrays, new(plain)},
+		{"interface", arrays, new(interface{})},
+		{"slice", arrays, new([]interface{})},
+		{"skipped map", maps, new(plain)},
+		{"interface map", maps, new(interface{})},
+	}
+	for _, tt := range tests {
+		err := NewMsgpackMarshaler().Unmarshal(tt.in, tt.v)
+		if !errors.Is(err, errTooDeep) {
+			t.Errorf("%s: expect max depth error, got %v", tt.name, err)
+		}
+		cc := NewMsgpackCodec(bufConn{bytes.NewBuffer(tt.in)})
+		if err = cc.ReadBody(tt.v); !errors.Is(err, errTooDeep) {
+			t.Errorf("%s: expect max depth error of stream codec, got %v", tt.name, err)
+		}
+	}
+
+	// nesting below the limit is decoded
+	var v interface{}
+	ok := append(bytes.Repeat([]byte{0x91}, maxDepth-1), 0x01)
+	if err := NewMsgpackMarshaler().Unmarshal(ok, &v); err != nil {
+		t.Errorf("expect %d levels decoded, got %v", maxDepth, err)
+	}
+}
+
+func TestMsgpack_SliceAlloc(t *testing.T) {
+	// a length of 1M elements followed by 1MB, of which the first is invalid
+	const n = 1 << 20
+	in := make([]byte, 5+n)
+	in[0] = mpArray32
+	binary.BigEndian.PutUint32(in[1:], n)
+	in[5] = 0xc1
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var s [][1024]byte
+	if err := NewMsgpackMarshaler().Unmarshal(in, &s); err == nil {
+		t.Fatal("expect invalid element error")
+	}
+	var v interface{}
+	if err := NewMsgpackMarshaler().Unmarshal(in, &v); err == nil {
+		t.Fatal("expect invalid element error of interface")
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+		t.Errorf("expect elements allocated as read, got %d bytes allocated", alloc)
+	}
+}
+
+// msgpackUser is encoded with the names of its tags
+type msgpackUser struct {
+	Name  string    `msgpack:"name"`
+	Email string    `msgpack:"email,omitempty"`
+	Token string    `msgpack:"-"`
+	Seen  time.Time `msgpack:"seen"`
+}
+
+func TestMsgpack_Vectors(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		out  []byte
+	}{
+		{"fixint", 1, []byte{0x01}},
+		{"negative fixint", -1, []byte{0xff}},
+		{"uint8", 200, []byte{0xcc, 0xc8}},
+		{"int16", -200, []byte{0xd1, 0xff, 0x38}},
+		{"uint32", uint32(1 << 20), []byte{0xce, 0x00, 0x10, 0x00, 0x00}},
+		{"float64", 1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"bool", true, []byte{0xc3}},
+		{"fixstr", "hi", []byte{0xa2, 'h', 'i'}},
+		{"str8", strings.Repeat("a", 32), append([]byte{0xd9, 0x20}, strings.Repeat("a", 32)...)},
+		{"bin8", []byte{1, 2}, []byte{0xc4, 0x02, 0x01, 0x02}},
+		{"fixarray", []int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{"fixmap", map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{"timestamp32", time.Unix(1, 0), []byte{0xd6, 0xff, 0, 0, 0, 1}},
+		{"timestamp64", time.Unix(1, 1), []byte{0xd7, 0xff, 0, 0, 0, 0x04, 0, 0, 0, 0x01}},
+		{"timestamp96", time.Unix(1<<34, 1), []byte{0xc7, 0x0c, 0xff, 0, 0, 0, 1, 0, 0, 0, 0x04, 0, 0, 0, 0}},
+		{"struct", msgpackUser{Name: "a", Token: "t", Seen: time.Unix(1, 0)},
+			[]byte{0x82, 0xa4, 'n', 'a', 'm', 'e', 0xa1, 'a', 0xa4, 's', 'e', 'e', 'n', 0xd6, 0xff, 0, 0, 0, 1}},
+	}
+	for _, tt := range tests {
+		out, err := NewMsgpackMarshaler().Marshal(tt.v)
+		if err != nil || !bytes.Equal(out, tt.out) {
+			t.Errorf("%s: expect % x, got % x, %v", tt.name, tt.out, out, err)
+			continue
+		}
+		v := reflect.New(reflect.TypeOf(tt.v))
+		if err = NewMsgpackMarshaler().Unmarshal(tt.out, v.Interface()); err != nil {
+			t.Errorf("%s: expect decoded, got %v", tt.name, err)
+			continue
+		}
+		// times are decoded in the local location
+		if u, ok := tt.v.(msgpackUser); ok {
+			u.Token, u.Seen = "", v.Elem().Interface().(msgpackUser).Seen
+			tt.v = u
+		}
+		if tm, ok := tt.v.(time.Time); ok {
+			if !tm.Equal(v.Elem().Interface().(time.Time)) {
+				t.Errorf("%s: expect %v, got %v", tt.name, tm, v.Elem())
+			}
+			continue
+		}
+		if !reflect.DeepEqual(v.Elem().Interface(), tt.v) {
+			t.Errorf("%s: expect %v, got %v", tt.name, tt.v, v.Elem())
+		}
+	}
+}
+
+func TestMsgpack_Interface(t *testing.T) {
+	in := []byte{0x84,
+		0xa1, 'b', 0xc4, 0x01, 0x07, // bin
+		0xa1, 't', 0xd6, 0xff, 0, 0, 0, 1, // timestamp
+		0xa1, 'a', 0x92, 0xff, 0xcc, 0xc8, // array of int and uint
+		0xa1, 'm', 0x81, 0x01, 0xc0, // map of an integer key
+	}
+	var v interface{}
+	if err := NewMsgpackMarshaler().Unmarshal(in, &v); err != nil {
+		t.Fatalf("expect decoded, got %v", err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expect map[string]interface{}, got %T", v)
+	}
+	if b, ok := m["b"].([]byte); !ok || !bytes.Equal(b, []byte{7}) {
+		t.Errorf("expect bin as []byte, got %#v", m["b"])
+	}
+	if tm, ok := m["t"].(time.Time); !ok || !tm.Equal(time.Unix(1, 0)) {
+		t.Errorf("expect timestamp as time.Time, got %#v", m["t"])
+	}
+	if !reflect.DeepEqual(m["a"], []interface{}{int64(-1), uint64(200)}) {
+		t.Errorf("expect array of int64 and uint64, got %#v", m["a"])
+	}
+	if !reflect.DeepEqual(m["m"], map[interface{}]interface{}{int64(1): nil}) {
+		t.Errorf("expect map[interface{}]interface{}, got %#v", m["m"])
+	}
+}
+
+func TestMsgpack_Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		v    interface{}
+	}{
+		{"empty", nil, new(int)},
+		{"truncated uint16", []byte{0xcd, 0x01}, new(int)},
+		{"truncated str", []byte{0xa5, 'a'}, new(string)},
+		{"truncated bin", []byte{0xc4, 0x05, 0x01}, new([]byte)},
+		{"truncated array", []byte{0x92, 0x01}, new([]int)},
+		{"truncated map", []byte{0x81, 0xa1, 'a'}, new(map[string]int)},
+		{"truncated timestamp", []byte{0xd6, 0xff, 0, 0}, new(time.Time)},
+		{"truncated skipped", []byte{0x81, 0xa1, 'x', 0xa5}, new(msgpackUser)},
+		{"length beyond input", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, new([]int)},
+		{"reserved format", []byte{0xc1}, new(interface{})},
+		{"invalid timestamp", []byte{0xc7, 0x03, 0xff, 0, 0, 0}, new(time.Time)},
+		{"unhashable key", []byte{0x81, 0x90, 0x01}, new(interface{})},
+		{"non-pointer", []byte{0x01}, 0},
+	}
+	for _, tt := range tests {
+		if err := NewMsgpackMarshaler().Unmarshal(tt.in, tt.v); err == nil {
+			t.Errorf("%s: expect error", tt.name)
+		}
+		cc := NewMsgpackCodec(bufConn{bytes.NewBuffer(tt.in)})
+		if err := cc.ReadBody(tt.v); err == nil {
+			t.Errorf("%s: expect error of stream codec", tt.name)
+		}
+	}
+}
+
+func TestMsgpack_WrongType(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		v    interface{}
+	}{
+		{"string into int", []byte{0xa1, 'a'}, new(int)},
+		{"int into string", []byte{0x01}, new(string)},
+		{"overflow", []byte{0xcc, 0xff}, new(int8)},
+		{"negative into uint", []byte{0xff}, new(uint)},
+		{"array into struct", []byte{0x91, 0x01}, new(msgpackUser)},
+		{"map into slice", []byte{0x81, 0xa1, 'a', 0x01}, new([]int)},
+		{"str into time", []byte{0xa1, 'a'}, new(time.Time)},
+		{"other ext into time", []byte{0xd4, 0x01, 0x00}, new(time.Time)},
+		{"wrong field", []byte{0x81, 0xa4, 'n', 'a', 'm', 'e', 0x01}, new(msgpackUser)},
+	}
+	for _, tt := range tests {
+		if err := NewMsgpackMarshaler().Unmarshal(tt.in, tt.v); err == nil {
+			t.Errorf("%s: expect error", tt.name)
+		}
+		// the value is skipped, so that the next one is still read
+		cc := NewMsgpackCodec(bufConn{bytes.NewBuffer(append(tt.in, 0x07))})
+		if err := cc.ReadBody(tt.v); err == nil {
+			t.Errorf("%s: expect error of stream codec", tt.name)
+		}
+		var n int
+		if err := cc.ReadBody(&n); err != nil || n != 7 {
+			t.Errorf("%s: expect next value read, got %d, %v", tt.name, n, err)
+		}
+	}
+}
+
+func TestMsgpack_LongLength(t *testing.T) {
+	// lengths of 4GB followed by a few bytes, read without limits
+	tests := []struct {
+		name string
+		in   []byte
+		v    interface{}
+	}{
+		{"str32", []byte{mpStr32, 0xff, 0xff, 0xff, 0xff, 'a'}, new(string)},
+		{"bin32", []byte{mpBin32, 0xff, 0xff, 0xff, 0xff, 0x01}, new([]byte)},
+		{"interface", []byte{mpBin32, 0xff, 0xff, 0xff, 0xff, 0x01}, new(interface{})},
+	}
+	for _, tt := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		cc := NewMsgpackCodec(bufConn{bytes.NewBuffer(tt.in)})
+		if err := cc.ReadBody(tt.v); err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: expect unexpected EOF, got %v", tt.name, err)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+			t.Errorf("%s: expect bytes allocated as read, got %d bytes allocated", tt.name, alloc)
+		}
+	}
+
+	// long values are read whole
+	long := strings.Repeat("a", 3*readChunk+1)
+	b, _ := NewMsgpackMarshaler().Marshal(long)
+	var s string
+	if err := NewMsgpackCodec(bufConn{bytes.NewBuffer(b)}).ReadBody(&s); err != nil || s != long {
+		t.Errorf("expect long string read, got %d bytes, %v", len(s), err)
+	}
+}
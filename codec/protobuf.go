@@ -0,0 +1,705 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProtobufCodec encodes headers and bodies in protobuf wire format,
+// each one is a message prefixed by its varint length. Field numbers
+// are given by the protobuf tag, eg
+//
+//	ID    int64    `protobuf:"1"`
+//	Delta int32    `protobuf:"2,zigzag"` // sint32
+//	Hash  uint64   `protobuf:"3,fixed"`  // fixed64
+//	Tags  []string `protobuf:"4"`        // repeated string
+//	Note  *string  `protobuf:"5"`        // optional string
+//	Owner *User    `protobuf:"6"`        // nested message
+//	Skip  string   `protobuf:"-"`
+//
+// Tags of protoc-gen-go, such as `protobuf:"varint,1,opt,name=id"`, are
+// read as well. Exported fields of a struct without any protobuf tag
+// are numbered from 1 in order. Slices are repeated fields, packed if
+// they are numeric, maps are repeated entries of key 1 and value 2,
+// pointers have presence, and time.Time is google.protobuf.Timestamp.
+// Bodies which aren't structs are wrapped as field 1 of a message, like
+// google.protobuf.Int64Value. Header is the message
+//
+//	message Header {
+//		string service_method = 1;
+//		uint64 seq = 2;
+//		string error = 3;
+//		uint32 code = 4;
+//		repeated string details = 5;
+//		int64 timeout = 6; // nanoseconds
+//		uint32 kind = 7;
+//		map<string, string> metadata = 8;
+//		repeated string batch = 9;
+//		bool reverse = 10;
+//	}
+type ProtobufCodec struct {
+	conn      io.ReadWriteCloser
+	buf       *bufio.Writer
+	r         *bufio.Reader
+	msg       []byte // scratch of the message being written
+	maxHeader int    // limits of messages, 0 means no limit
+	maxBody   int
+}
+
+var _ Codec = (*ProtobufCodec)(nil)
+var _ BatchWriter = (*ProtobufCodec)(nil)
+var _ Limiter = (*ProtobufCodec)(nil)
+
+// NewProtobufCodec init protobuf codec
+func NewProtobufCodec(conn io.ReadWriteCloser) Codec {
+	return &ProtobufCodec{
+		conn: conn,
+		buf:  bufio.NewWriter(conn),
+		r:    bufio.NewReader(conn),
+	}
+}
+
+// SetLimits makes c fail before reading a message longer than the limits
+func (c *ProtobufCodec) SetLimits(maxHeader, maxBody int) {
+	c.maxHeader, c.maxBody = maxHeader, maxBody
+}
+
+// readMessage reads the next length-prefixed message,
+// which must not be longer than limit
+func (c *ProtobufCodec) readMessage(limit int) ([]byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && n > uint64(limit) {
+		return nil, tooLarge(limit)
+	}
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("protobuf: invalid message length %d", n)
+	}
+	// without limit, the message grows as it's read
+	return readFull(c.r, int(n))
+}
+
+func (c *ProtobufCodec) ReadHeader(h *Header) error {
+	b, err := c.readMessage(c.maxHeader)
+	if err != nil {
+		return err
+	}
+	return unmarshalProto(b, reflect.ValueOf(h).Elem())
+}
+
+func (c *ProtobufCodec) ReadBody(body interface{}) error {
+	// every message is read whole, so a body which can't be
+	// decoded doesn't affect the next one
+	b, err := c.readMessage(c.maxBody)
+	if err != nil || body == nil {
+		return err
+	}
+	return unmarshalBody(b, body)
+}
+
+// unmarshalBody decodes message b into the value body points to
+func unmarshalBody(b []byte, body interface{}) error {
+	rv := reflect.ValueOf(body)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("protobuf: decode into non-pointer %T", body)
+	}
+	return unmarshalProto(b, rv.Elem())
+}
+
+func (c *ProtobufCodec) Write(h *Header, body interface{}) (err error) {
+	return c.WriteBatch(h, []interface{}{body})
+}
+
+// WriteBatch write msg to header and every body of the batch, then flush once
+func (c *ProtobufCodec) WriteBatch(h *Header, bodies []interface{}) (err error) {
+	// close connect
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	// the message is encoded before it's written, so that an
+	// unsupported body doesn't leave half of it on the connection
+	var out []byte
+	if out, err = c.appendMessage(out, reflect.ValueOf(h)); err != nil {
+		log.Println("rpc codec: protobuf error encoding header:", err)
+		return err
+	}
+	for _, body := range bodies {
+		if out, err = c.appendMessage(out, reflect.ValueOf(body)); err != nil {
+			log.Println("rpc codec: protobuf error encoding body:", err)
+			return err
+		}
+	}
+	_, err = c.buf.Write(out)
+	return err
+}
+
+// appendMessage appends v prefixed by its length to b
+func (c *ProtobufCodec) appendMessage(b []byte, v reflect.Value) ([]byte, error) {
+	var err error
+	if c.msg, err = marshalProto(c.msg[:0], v); err != nil {
+		return b, err
+	}
+	b = binary.AppendUvarint(b, uint64(len(c.msg)))
+	return append(b, c.msg...), nil
+}
+
+func (c *ProtobufCodec) Close() error {
+	return c.conn.Close()
+}
+
+// wire types of protobuf
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoField is a field of struct encoded as a protobuf field
+type protoField struct {
+	num    uint64
+	index  []int
+	zigzag bool // sint32 or sint64
+	fixed  bool // fixed32, fixed64, sfixed32 or sfixed64
+}
+
+// protoFields caches the fields of struct types
+var protoFields sync.Map
+
+// protoFieldsOf returns the encoded fields of struct type t
+func protoFieldsOf(t reflect.Type) ([]protoField, error) {
+	if f, ok := protoFields.Load(t); ok {
+		return f.([]protoField), nil
+	}
+	tagged := false
+	for i := 0; i < t.NumField(); i++ {
+		if _, ok := t.Field(i).Tag.Lookup("protobuf"); ok {
+			tagged = true
+			break
+		}
+	}
+	var fields []protoField
+	seen := make(map[uint64]string)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		f := protoField{index: []int{i}}
+		if !tagged {
+			f.num = uint64(len(fields) + 1)
+		} else {
+			tag, ok := sf.Tag.Lookup("protobuf")
+			if !ok || tag == "-" {
+				continue
+			}
+			for _, opt := range strings.Split(tag, ",") {
+				if n, err := strconv.ParseUint(opt, 10, 29); err == nil && f.num == 0 {
+					f.num = n
+				}
+				switch opt {
+				case "zigzag", "zigzag32", "zigzag64":
+					f.zigzag = true
+				case "fixed", "fixed32", "fixed64", "sfixed32", "sfixed64":
+					f.fixed = true
+				}
+			}
+			if f.num == 0 {
+				return nil, fmt.Errorf("protobuf: no field number in tag of %s.%s", t, sf.Name)
+			}
+		}
+		if name, ok := seen[f.num]; ok {
+			return nil, fmt.Errorf("protobuf: field number %d of %s.%s is used by %s", f.num, t, sf.Name, name)
+		}
+		seen[f.num] = sf.Name
+		fields = append(fields, f)
+	}
+	protoFields.Store(t, fields)
+	return fields, nil
+}
+
+// isMessage return true if values of t are encoded as messages
+func isMessage(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType
+}
+
+// isPackable return true if repeated values of t are packed
+func isPackable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// wireType returns the wire type of a single value of t
+func wireType(t reflect.Type, f *protoField) int {
+	switch t.Kind() {
+	case reflect.Bool:
+		return wireVarint
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if !f.fixed {
+			return wireVarint
+		}
+		if t.Size() <= 4 {
+			return wireFixed32
+		}
+		return wireFixed64
+	case reflect.Float32:
+		return wireFixed32
+	case reflect.Float64:
+		return wireFixed64
+	}
+	return wireBytes
+}
+
+// marshalProto appends the message of v to b, v is wrapped
+// as field 1 if it isn't a struct
+func marshalProto(b []byte, v reflect.Value) ([]byte, error) {
+	for v.IsValid() && (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return b, nil
+	}
+	if !isMessage(v.Type()) {
+		return appendField(b, &protoField{num: 1}, v)
+	}
+	return appendStruct(b, v)
+}
+
+func appendStruct(b []byte, v reflect.Value) ([]byte, error) {
+	fields, err := protoFieldsOf(v.Type())
+	if err != nil {
+		return b, err
+	}
+	for i := range fields {
+		if b, err = appendField(b, &fields[i], v.FieldByIndex(fields[i].index)); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func appendKey(b []byte, num uint64, wt int) []byte {
+	return binary.AppendUvarint(b, num<<3|uint64(wt))
+}
+
+// appendField appends field f of value v to b, zero values are
+// omitted unless they are pointed to
+func appendField(b []byte, f *protoField, v reflect.Value) ([]byte, error) {
+	var err error
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return b, nil
+		}
+		return appendValue(b, f, v.Elem())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 || v.Len() == 0 {
+			break
+		}
+		et := v.Type().Elem()
+		if isPackable(et) {
+			var packed []byte
+			for i := 0; i < v.Len(); i++ {
+				packed = appendScalar(packed, f, v.Index(i))
+			}
+			b = appendKey(b, f.num, wireBytes)
+			b = binary.AppendUvarint(b, uint64(len(packed)))
+			return append(b, packed...), nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			e := v.Index(i)
+			if e.Kind() == reflect.Pointer && e.IsNil() {
+				return b, fmt.Errorf("protobuf: nil element of repeated field %d", f.num)
+			}
+			if b, err = appendValue(b, f, reflect.Indirect(e)); err != nil {
+				return b, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			var entry []byte
+			if entry, err = appendValue(entry, &protoField{num: 1}, iter.Key()); err != nil {
+				return b, err
+			}
+			// a nil value is sent as an entry without value
+			if ev := reflect.Indirect(iter.Value()); ev.IsValid() {
+				if entry, err = appendValue(entry, &protoField{num: 2}, ev); err != nil {
+					return b, err
+				}
+			}
+			b = appendKey(b, f.num, wireBytes)
+			b = binary.AppendUvarint(b, uint64(len(entry)))
+			b = append(b, entry...)
+		}
+		return b, nil
+	}
+	if v.IsZero() {
+		return b, nil
+	}
+	return appendValue(b, f, v)
+}
+
+// appendValue appends key and value of a single value v of field f
+func appendValue(b []byte, f *protoField, v reflect.Value) ([]byte, error) {
+	t := v.Type()
+	switch {
+	case t == timeType:
+		ts := v.Interface().(time.Time)
+		var msg []byte
+		if sec := ts.Unix(); sec != 0 {
+			msg = binary.AppendUvarint(appendKey(msg, 1, wireVarint), uint64(sec))
+		}
+		if nsec := ts.Nanosecond(); nsec != 0 {
+			msg = binary.AppendUvarint(appendKey(msg, 2, wireVarint), uint64(nsec))
+		}
+		return appendBytes(b, f.num, msg), nil
+	case t.Kind() == reflect.Struct:
+		msg, err := appendStruct(nil, v)
+		if err != nil {
+			return b, err
+		}
+		return appendBytes(b, f.num, msg), nil
+	case t.Kind() == reflect.String:
+		return appendBytes(b, f.num, []byte(v.String())), nil
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return appendBytes(b, f.num, v.Bytes()), nil
+	case isPackable(t):
+		return appendScalar(appendKey(b, f.num, wireType(t, f)), f, v), nil
+	}
+	return b, fmt.Errorf("protobuf: unsupported type %s of field %d", t, f.num)
+}
+
+func appendBytes(b []byte, num uint64, data []byte) []byte {
+	b = appendKey(b, num, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendScalar appends the numeric value v without key
+func appendScalar(b []byte, f *protoField, v reflect.Value) []byte {
+	var u uint64
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			u = 1
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if f.zigzag && !f.fixed {
+			u = uint64(n<<1) ^ uint64(n>>63)
+		} else {
+			u = uint64(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u = v.Uint()
+	case reflect.Float32:
+		u = uint64(math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		u = math.Float64bits(v.Float())
+	}
+	switch wireType(v.Type(), f) {
+	case wireFixed32:
+		return binary.LittleEndian.AppendUint32(b, uint32(u))
+	case wireFixed64:
+		return binary.LittleEndian.AppendUint64(b, u)
+	}
+	return binary.AppendUvarint(b, u)
+}
+
+var errTruncated = errors.New("protobuf: truncated message")
+
+// protoValue is the value of a field read from the wire
+type protoValue struct {
+	wt   int
+	u    uint64 // varint, fixed32 or fixed64
+	data []byte // length-delimited
+}
+
+// eachField calls fn with every field of message b in order
+func eachField(b []byte, fn func(num uint64, pv protoValue) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		pv := protoValue{wt: int(key & 7)}
+		switch pv.wt {
+		case wireVarint:
+			pv.u, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			pv.u, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			pv.u, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errTruncated
+			}
+			pv.data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", pv.wt)
+		}
+		if err := fn(key>>3, pv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshalProto decodes message b into v, v is unwrapped from
+// field 1 if it isn't a struct
+func unmarshalProto(b []byte, v reflect.Value) error {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	v.Set(reflect.Zero(v.Type()))
+	if !isMessage(v.Type()) {
+		f := &protoField{num: 1}
+		return eachField(b, func(num uint64, pv protoValue) error {
+			if num != 1 {
+				return nil
+			}
+			return decodeField(f, v, pv, 0)
+		})
+	}
+	return decodeStruct(b, v, 0)
+}
+
+// decodeStruct decodes message b into struct v nested in depth messages
+func decodeStruct(b []byte, v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return errTooDeep
+	}
+	fields, err := protoFieldsOf(v.Type())
+	if err != nil {
+		return err
+	}
+	// unknown fields are dropped
+	return eachField(b, func(num uint64, pv protoValue) error {
+		for i := range fields {
+			if fields[i].num == num {
+				return decodeField(&fields[i], v.FieldByIndex(fields[i].index), pv, depth+1)
+			}
+		}
+		return nil
+	})
+}
+
+// decodeField decodes a value of field f into v, values of
+// repeated fields and maps are added to v
+func decodeField(f *protoField, v reflect.Value, pv protoValue, depth int) error {
+	t := v.Type()
+	switch {
+	case t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8:
+		et := t.Elem()
+		if pv.wt == wireBytes && isPackable(et) {
+			return decodePacked(f, v, pv.data)
+		}
+		e := reflect.New(et).Elem()
+		if err := decodeValue(f, e, pv, depth); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, e))
+		return nil
+	case t.Kind() == reflect.Map:
+		if pv.wt != wireBytes {
+			return fmt.Errorf("protobuf: wire type %d of field %d doesn't match %s", pv.wt, f.num, t)
+		}
+		key := reflect.New(t.Key()).Elem()
+		elem := reflect.New(t.Elem()).Elem()
+		err := eachField(pv.data, func(num uint64, pv protoValue) error {
+			switch num {
+			case 1:
+				return decodeValue(&protoField{num: 1}, key, pv, depth)
+			case 2:
+				return decodeValue(&protoField{num: 2}, elem, pv, depth)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(t))
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	}
+	return decodeValue(f, v, pv, depth)
+}
+
+// decodePacked appends the packed values of data to slice v
+func decodePacked(f *protoField, v reflect.Value, data []byte) error {
+	et := v.Type().Elem()
+	pv := protoValue{wt: wireType(et, f)}
+	for len(data) > 0 {
+		switch pv.wt {
+		case wireVarint:
+			var n int
+			pv.u, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			pv.u, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			pv.u, data = binary.LittleEndian.Uint64(data), data[8:]
+		}
+		e := reflect.New(et).Elem()
+		// packed values are scalars, they nest no message
+		if err := decodeValue(f, e, pv, 0); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, e))
+	}
+	return nil
+}
+
+// decodeValue decodes a single value of field f into v,
+// which is nested in depth messages
+func decodeValue(f *protoField, v reflect.Value, pv protoValue, depth int) error {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	t := v.Type()
+	if pv.wt != wireType(t, f) {
+		return fmt.Errorf("protobuf: wire type %d of field %d doesn't match %s", pv.wt, f.num, t)
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		v.SetBool(pv.u != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch {
+		case pv.wt == wireFixed32:
+			n = int64(int32(pv.u))
+		case f.zigzag && !f.fixed:
+			n = int64(pv.u>>1) ^ -int64(pv.u&1)
+		default:
+			n = int64(pv.u)
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("protobuf: %d of field %d overflows %s", n, f.num, t)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.OverflowUint(pv.u) {
+			return fmt.Errorf("protobuf: %d of field %d overflows %s", pv.u, f.num, t)
+		}
+		v.SetUint(pv.u)
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(uint32(pv.u))))
+	case reflect.Float64:
+		v.SetFloat(math.Float64frombits(pv.u))
+	case reflect.String:
+		v.SetString(string(pv.data))
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("protobuf: unsupported type %s of field %d", t, f.num)
+		}
+		v.SetBytes(append([]byte{}, pv.data...))
+	case reflect.Struct:
+		if t == timeType {
+			return decodeTimestamp(pv.data, v)
+		}
+		return decodeStruct(pv.data, v, depth)
+	default:
+		return fmt.Errorf("protobuf: unsupported type %s of field %d", t, f.num)
+	}
+	return nil
+}
+
+// decodeTimestamp decodes google.protobuf.Timestamp into v
+func decodeTimestamp(b []byte, v reflect.Value) error {
+	var sec, nsec int64
+	err := eachField(b, func(num uint64, pv protoValue) error {
+		if pv.wt != wireVarint {
+			return fmt.Errorf("protobuf: wire type %d of timestamp field %d", pv.wt, num)
+		}
+		switch num {
+		case 1:
+			sec = int64(pv.u)
+		case 2:
+			nsec = int64(int32(pv.u))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(time.Unix(sec, nsec)))
+	return nil
+}
+
+// ProtobufMarshaler encodes payloads of frames in protobuf wire format
+type ProtobufMarshaler struct {
+	buf []byte
+}
+
+var _ Marshaler = (*ProtobufMarshaler)(nil)
+
+// NewProtobufMarshaler init protobuf marshaler
+func NewProtobufMarshaler() Marshaler {
+	return new(ProtobufMarshaler)
+}
+
+func (m *ProtobufMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var err error
+	m.buf, err = marshalProto(m.buf[:0], reflect.ValueOf(v))
+	return m.buf, err
+}
+
+func (m *ProtobufMarshaler) Unmarshal(data []byte, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	return unmarshalBody(data, v)
+}
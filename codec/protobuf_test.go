@@ -0,0 +1,198 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// protoNode is a recursive message, which is nested by field 1
+type protoNode struct {
+	Next *protoNode `protobuf:"1"`
+	Leaf int        `protobuf:"2"`
+}
+
+// nestedNodes returns the message of n nested protoNode
+func nestedNodes(n int) []byte {
+	m := []byte{0x10, 0x01} // leaf 1
+	for i := 1; i < n; i++ {
+		m = append(binary.AppendUvarint([]byte{0x0a}, uint64(len(m))), m...)
+	}
+	return m
+}
+
+func TestProtobuf_MaxDepth(t *testing.T) {
+	deep := nestedNodes(maxDepth + 2)
+	var node protoNode
+	if err := NewProtobufMarshaler().Unmarshal(deep, &node); !errors.Is(err, errTooDeep) {
+		t.Errorf("expect max depth error, got %v", err)
+	}
+	msg := append(binary.AppendUvarint(nil, uint64(len(deep))), deep...)
+	cc := NewProtobufCodec(bufConn{bytes.NewBuffer(msg)})
+	if err := cc.ReadBody(&node); !errors.Is(err, errTooDeep) {
+		t.Errorf("expect max depth error of stream codec, got %v", err)
+	}
+
+	// nesting below the limit is decoded
+	node = protoNode{}
+	if err := NewProtobufMarshaler().Unmarshal(nestedNodes(100), &node); err != nil {
+		t.Fatalf("expect nested nodes decoded, got %v", err)
+	}
+	n := 1
+	for p := &node; p.Next != nil; p = p.Next {
+		n++
+	}
+	if n != 100 {
+		t.Errorf("expect 100 nodes, got %d", n)
+	}
+}
+
+// protoTest is the message of the examples of the protobuf encoding guide
+type protoTest struct {
+	A int32            `protobuf:"varint,1,opt,name=a"`
+	B string           `protobuf:"2"`
+	C *protoTest       `protobuf:"3"`
+	D []int32          `protobuf:"4"`
+	E int32            `protobuf:"5,zigzag"`
+	F float64          `protobuf:"6"`
+	G []byte           `protobuf:"7"`
+	H map[string]int32 `protobuf:"8"`
+	I uint32           `protobuf:"9,fixed"`
+	J int32            `protobuf:"sfixed32,10,opt,name=j,proto3"`
+	K int64            `protobuf:"sfixed64,11,opt,name=k,proto3"`
+	L int64            `protobuf:"zigzag64,12,opt,name=l,proto3"`
+	M uint64           `protobuf:"fixed64,13,opt,name=m,proto3"`
+	N float32          `protobuf:"fixed32,14,opt,name=n,proto3"`
+}
+
+func TestProtobuf_Vectors(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		out  []byte
+	}{
+		{"varint", protoTest{A: 150}, []byte{0x08, 0x96, 0x01}},
+		{"string", protoTest{B: "testing"}, []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{"nested", protoTest{C: &protoTest{A: 150}}, []byte{0x1a, 0x03, 0x08, 0x96, 0x01}},
+		{"packed", protoTest{D: []int32{3, 270, 86942}}, []byte{0x22, 0x06, 0x03, 0x8e, 0x02, 0x9e, 0xa7, 0x05}},
+		{"zigzag", protoTest{E: -2}, []byte{0x28, 0x03}},
+		{"double", protoTest{F: 1.5}, []byte{0x31, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{"bytes", protoTest{G: []byte{1, 2}}, []byte{0x3a, 0x02, 0x01, 0x02}},
+		{"map", protoTest{H: map[string]int32{"a": 1}}, []byte{0x42, 0x05, 0x0a, 0x01, 'a', 0x10, 0x01}},
+		{"fixed32", protoTest{I: 1}, []byte{0x4d, 0x01, 0, 0, 0}},
+		{"sfixed32", protoTest{J: -1}, []byte{0x55, 0xff, 0xff, 0xff, 0xff}},
+		{"sfixed64", protoTest{K: -2}, []byte{0x59, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"zigzag64", protoTest{L: -1}, []byte{0x60, 0x01}},
+		{"fixed64", protoTest{M: 1}, []byte{0x69, 0x01, 0, 0, 0, 0, 0, 0, 0}},
+		{"float", protoTest{N: 1.5}, []byte{0x75, 0, 0, 0xc0, 0x3f}},
+		{"wrapped int64", int64(150), []byte{0x08, 0x96, 0x01}},
+		{"wrapped string", "hi", []byte{0x0a, 0x02, 'h', 'i'}},
+		{"zero", protoTest{}, nil},
+	}
+	for _, tt := range tests {
+		out, err := NewProtobufMarshaler().Marshal(tt.v)
+		if err != nil || !bytes.Equal(out, tt.out) {
+			t.Errorf("%s: expect % x, got % x, %v", tt.name, tt.out, out, err)
+			continue
+		}
+		v := reflect.New(reflect.TypeOf(tt.v))
+		if err = NewProtobufMarshaler().Unmarshal(tt.out, v.Interface()); err != nil {
+			t.Errorf("%s: expect decoded, got %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(v.Elem().Interface(), tt.v) {
+			t.Errorf("%s: expect %+v, got %+v", tt.name, tt.v, v.Elem())
+		}
+	}
+}
+
+func TestProtobuf_Timestamp(t *testing.T) {
+	tests := []struct {
+		tm  time.Time
+		out []byte
+	}{
+		{time.Unix(1, 2), []byte{0x0a, 0x04, 0x08, 0x01, 0x10, 0x02}},
+		{time.Unix(0, 0), []byte{0x0a, 0x00}}, // the epoch isn't the zero time
+		{time.Time{}, nil},
+	}
+	for _, tt := range tests {
+		out, err := NewProtobufMarshaler().Marshal(tt.tm)
+		if err != nil || !bytes.Equal(out, tt.out) {
+			t.Errorf("%v: expect % x, got % x, %v", tt.tm, tt.out, out, err)
+			continue
+		}
+		var tm time.Time
+		if err = NewProtobufMarshaler().Unmarshal(tt.out, &tm); err != nil || !tm.Equal(tt.tm) {
+			t.Errorf("%v: expect decoded, got %v, %v", tt.tm, tm, err)
+		}
+	}
+}
+
+func TestProtobuf_Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		v    interface{}
+	}{
+		{"truncated key", []byte{0x80}, new(protoTest)},
+		{"truncated varint", []byte{0x08, 0x96}, new(protoTest)},
+		{"truncated bytes", []byte{0x12, 0x07, 't'}, new(protoTest)},
+		{"truncated fixed64", []byte{0x31, 0, 0}, new(protoTest)},
+		{"truncated fixed32", []byte{0x4d, 0}, new(protoTest)},
+		{"truncated packed", []byte{0x22, 0x01, 0x8e}, new(protoTest)},
+		{"truncated map entry", []byte{0x42, 0x02, 0x0a, 0x05}, new(protoTest)},
+		{"truncated nested", []byte{0x1a, 0x02, 0x08, 0x96}, new(protoTest)},
+		{"truncated unknown field", []byte{0x50, 0x80}, new(protoTest)},
+		{"group wire type", []byte{0x0b}, new(protoTest)},
+		{"varint into string", []byte{0x10, 0x01}, new(protoTest)},
+		{"bytes into int", []byte{0x08 | wireBytes, 0x01, 0x00}, new(protoTest)},
+		{"varint into map", []byte{0x40, 0x01}, new(protoTest)},
+		{"overflow", []byte{0x08, 0x80, 0x80, 0x80, 0x80, 0x10}, new(protoTest)},
+		{"fixed64 timestamp", []byte{0x0a, 0x09, 0x09, 0, 0, 0, 0, 0, 0, 0, 0}, new(time.Time)},
+		{"non-pointer", []byte{0x08, 0x01}, 0},
+	}
+	for _, tt := range tests {
+		if err := NewProtobufMarshaler().Unmarshal(tt.in, tt.v); err == nil {
+			t.Errorf("%s: expect error", tt.name)
+		}
+		// every message is read whole, so the next one is still read
+		msg := append(binary.AppendUvarint(nil, uint64(len(tt.in))), tt.in...)
+		msg = append(msg, 0x02, 0x08, 0x07)
+		cc := NewProtobufCodec(bufConn{bytes.NewBuffer(msg)})
+		if err := cc.ReadBody(tt.v); err == nil {
+			t.Errorf("%s: expect error of stream codec", tt.name)
+		}
+		var n int
+		if err := cc.ReadBody(&n); err != nil || n != 7 {
+			t.Errorf("%s: expect next message read, got %d, %v", tt.name, n, err)
+		}
+	}
+}
+
+func TestProtobuf_StreamLength(t *testing.T) {
+	// the length of the message is beyond the input
+	cc := NewProtobufCodec(bufConn{bytes.NewBuffer([]byte{0x05, 0x08})})
+	if err := cc.ReadBody(new(protoTest)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expect unexpected EOF, got %v", err)
+	}
+	// lengths without limit fail at the end of input, or beyond what a
+	// message can be
+	cc = NewProtobufCodec(bufConn{bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0x07, 0x08})})
+	if err := cc.ReadBody(new(protoTest)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expect unexpected EOF without limit, got %v", err)
+	}
+	cc = NewProtobufCodec(bufConn{bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f})})
+	if err := cc.ReadBody(new(protoTest)); err == nil {
+		t.Error("expect invalid length without limit rejected")
+	}
+	// the length is beyond the limit, nothing is allocated for it
+	cc = NewProtobufCodec(bufConn{bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0x0f})})
+	cc.(Limiter).SetLimits(0, 1024)
+	if err := cc.ReadBody(new(protoTest)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expect too large error, got %v", err)
+	}
+}
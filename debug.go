@@ -10,20 +10,28 @@ import (
 const debugText = `<html>
 	<body>
 	<title>GeeRPC Services</title>
-	{{range .}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Panics</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
 			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=center>{{$mtype.NumPanics}}</td>
 			</tr>
 		{{end}}
 		</table>
 	{{end}}
+	<hr>
+	Limits
+	<hr>
+		<table>
+		<tr><td align=left>Max header size</td><td align=right>{{.MaxHeaderSize}}</td></tr>
+		<tr><td align=left>Max body size</td><td align=right>{{.MaxBodySize}}</td></tr>
+		</table>
 	</body>
 	</html>`
 
@@ -38,6 +46,12 @@ type debugService struct {
 	Method map[string]*methodType
 }
 
+type debugData struct {
+	Services      []debugService
+	MaxHeaderSize string
+	MaxBodySize   string
+}
+
 // Runs at /debug/geerpc
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// Build a sorted version of the data.
@@ -50,7 +64,12 @@ func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		})
 		return true
 	})
-	err := debug.Execute(w, services)
+	header, body := server.sizeLimits().sizes()
+	err := debug.Execute(w, debugData{
+		Services:      services,
+		MaxHeaderSize: sizeText(header),
+		MaxBodySize:   sizeText(body),
+	})
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
@@ -0,0 +1,141 @@
+package simplerpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+// Code is the error code sent in the header of response,
+// the values follow the codes of gRPC where they exist
+type Code uint32
+
+const (
+	CodeOK                Code = 0  // no error
+	CodeCanceled          Code = 1  // call cancelled by caller
+	CodeUnknown           Code = 2  // error without code, such as a plain error of handler
+	CodeInvalidArgument   Code = 3  // request is ill-formed or can't be decoded
+	CodeDeadlineExceeded  Code = 4  // deadline expired before the call completed
+	CodeNotFound          Code = 5  // service or method not found
+	CodePermissionDenied  Code = 7  // caller is not allowed to call the method
+	CodeResourceExhausted Code = 8  // some resource has been exhausted
+	CodeInternal          Code = 13 // internal error of server
+	CodeUnavailable       Code = 14 // server or connection is not available
+	CodeUnauthenticated   Code = 16 // client doesn't have valid credentials
+	CodePanic             Code = 17 // service method panicked
+)
+
+var codeNames = map[Code]string{
+	CodeOK:                "OK",
+	CodeCanceled:          "Canceled",
+	CodeUnknown:           "Unknown",
+	CodeInvalidArgument:   "InvalidArgument",
+	CodeDeadlineExceeded:  "DeadlineExceeded",
+	CodeNotFound:          "NotFound",
+	CodePermissionDenied:  "PermissionDenied",
+	CodeResourceExhausted: "ResourceExhausted",
+	CodeInternal:          "Internal",
+	CodeUnavailable:       "Unavailable",
+	CodeUnauthenticated:   "Unauthenticated",
+	CodePanic:             "Panic",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Error is an error sent across the wire with its code,
+// handlers can return it to choose the code sent to client
+type Error struct {
+	Code    Code
+	Message string
+	Details []string // optional details of error
+}
+
+// ErrPanic matches errors of calls whose service method panicked
+var ErrPanic = &Error{Code: CodePanic}
+
+// NewError returns an *Error with code, msg and details
+func NewError(code Code, msg string, details ...string) *Error {
+	return &Error{Code: code, Message: msg, Details: details}
+}
+
+// Errorf returns an *Error with code and formatted message
+func Errorf(code Code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is an *Error with the same code, the
+// message of target is ignored if it is empty. Canceled and
+// DeadlineExceeded errors also match the errors of context.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case context.Canceled:
+		return e.Code == CodeCanceled
+	case context.DeadlineExceeded:
+		return e.Code == CodeDeadlineExceeded
+	}
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code && (t.Message == "" || t.Message == e.Message)
+}
+
+// ErrorCode returns the code of err, CodeOK if err is nil
+// and CodeUnknown if err carries no code
+func ErrorCode(err error) Code {
+	if err == nil {
+		return CodeOK
+	}
+	return toError(err).Code
+}
+
+// toError converts err to an *Error, errors of context keep their meaning
+func toError(err error) *Error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		// keep what err adds to the wrapped *Error
+		if err != error(e) {
+			return &Error{Code: e.Code, Message: err.Error(), Details: e.Details}
+		}
+		return e
+	case errors.Is(err, context.Canceled):
+		return &Error{Code: CodeCanceled, Message: err.Error()}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Code: CodeDeadlineExceeded, Message: err.Error()}
+	default:
+		return &Error{Code: CodeUnknown, Message: err.Error()}
+	}
+}
+
+// setHeaderError writes err with its code and details into h
+func setHeaderError(h *codec.Header, err error) {
+	e := toError(err)
+	h.Error = e.Message
+	h.Code = uint32(e.Code)
+	h.Details = e.Details
+}
+
+// headerError returns the error written into h by server
+func headerError(h *codec.Header) error {
+	if h.Error == "" {
+		return nil
+	}
+	code := Code(h.Code)
+	if code == CodeOK {
+		// server doesn't send code
+		code = CodeUnknown
+	}
+	return &Error{Code: code, Message: h.Error, Details: h.Details}
+}
@@ -0,0 +1,237 @@
+package simplerpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+// ProtocolVersion is the version of the handshake and messages spoken
+// by this package. Clients of version 0 don't read HandshakeAck,
+// messages are frames of codec.FramedCodec since framedVersion.
+const ProtocolVersion = 2
+
+const framedVersion = 2
+
+// DefaultAckTimeout is how long clients wait for HandshakeAck
+// if Option.AckTimeout is 0
+const DefaultAckTimeout = 3 * time.Second
+
+// errNoAck is the error of a server which is older than HandshakeAck
+var errNoAck = NewError(CodeUnavailable, "rpc client: server doesn't acknowledge the handshake, it may need LegacyHandshake")
+
+// defaultCompressThreshold is used if Option.CompressThreshold is 0
+const defaultCompressThreshold = 1 << 10
+
+// DefaultHandshakeTimeout bounds the handshake of a connection,
+// which is TLS, option, ack and authentication
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// SetHandshakeTimeout sets the time a client has to complete the
+// handshake before server closes the connection, 0 means
+// DefaultHandshakeTimeout and a negative timeout means no limit
+func (server *Server) SetHandshakeTimeout(d time.Duration) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.handshakeTimeout = d
+}
+
+// SetHandshakeTimeout sets the handshake timeout of the DefaultServer.
+func SetHandshakeTimeout(d time.Duration) { DefaultServer.SetHandshakeTimeout(d) }
+
+// handshakeDeadline sets the deadline of the handshake on conn, it
+// returns the func which clears the deadline once handshake is done
+func (server *Server) handshakeDeadline(conn io.ReadWriteCloser) func() {
+	c, ok := conn.(interface{ SetDeadline(time.Time) error })
+	server.mu.Lock()
+	d := server.handshakeTimeout
+	server.mu.Unlock()
+	if d == 0 {
+		d = DefaultHandshakeTimeout
+	}
+	if !ok || d < 0 {
+		return func() {}
+	}
+	_ = c.SetDeadline(time.Now().Add(d))
+	return func() { _ = c.SetDeadline(time.Time{}) }
+}
+
+// withCompression makes the framed codecs of f compress bodies of at
+// least threshold bytes with the compressor of name
+func withCompression(f codec.NewCodecFunc, name codec.Compression, threshold int) codec.NewCodecFunc {
+	comp := codec.CompressorMap[name]
+	if comp == nil {
+		return f
+	}
+	if threshold <= 0 {
+		threshold = defaultCompressThreshold
+	}
+	return func(conn io.ReadWriteCloser) codec.Codec {
+		cc := f(conn)
+		if fc, ok := cc.(*codec.FramedCodec); ok {
+			fc.SetCompressor(comp, threshold)
+		}
+		return cc
+	}
+}
+
+// newCodecFunc returns the codec of type t for the connection of
+// version, or nil if there is no such codec
+func newCodecFunc(t codec.Type, version int) codec.NewCodecFunc {
+	if version < framedVersion {
+		return codec.NewCodecFuncMap[t]
+	}
+	if f := codec.NewMarshalerFuncMap[t]; f != nil {
+		return codec.NewFramedCodecFunc(f)
+	}
+	return nil
+}
+
+// capabilities of server announced in HandshakeAck
+const (
+	CapStreaming   = "streaming"   // client, server and bidi streams
+	CapMetadata    = "metadata"    // metadata of request and response
+	CapBatch       = "batch"       // calls of Batch in one frame
+	CapNotify      = "notify"      // one-way calls
+	CapReverse     = "reverse"     // server calls services of client
+	CapAuth        = "auth"        // client must authenticate in the handshake
+	CapCompression = "compression" // bodies can be compressed, see Option.Compression
+)
+
+// HandshakeAck is sent by server in reply to the Option of a client
+// of version 1 or later. If Error is not empty the connection is
+// rejected and closed by server.
+type HandshakeAck struct {
+	Version      int               // protocol version accepted by server
+	CodecType    codec.Type        // codec of the connection
+	Capabilities []string          // what server supports, such as CapStreaming
+	Compression  codec.Compression // compression of bodies, empty if they are not compressed
+	Code         Code              // code of Error
+	Error        string            // why the connection is rejected
+}
+
+// Has return true if server announces capability
+func (ack *HandshakeAck) Has(capability string) bool {
+	for _, c := range ack.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedCodecs returns the names of registered codecs
+func supportedCodecs() string {
+	types := make([]string, 0, len(codec.NewCodecFuncMap))
+	for t := range codec.NewCodecFuncMap {
+		types = append(types, string(t))
+	}
+	sort.Strings(types)
+	return strings.Join(types, ", ")
+}
+
+// handshake checks opt sent by client on conn and acks it, it returns
+// the codec of the connection or nil if the connection is rejected
+func (server *Server) handshake(conn io.Writer, opt *Option) codec.NewCodecFunc {
+	// clients of version 0 don't read the ack, so they are only told
+	// of the rejection by the connection being closed
+	reject := func(err *Error) codec.NewCodecFunc {
+		log.Println(err.Message)
+		if opt.Version > 0 {
+			_ = writeJSON(conn, &HandshakeAck{Code: err.Code, Error: err.Message})
+		}
+		return nil
+	}
+
+	// check if this request is rpc request
+	if opt.MagicNumber != MagicNumber {
+		return reject(Errorf(CodeInvalidArgument, "rpc server: invalid magic number %x", opt.MagicNumber))
+	}
+
+	// get corresponding codec to decode body
+	f := codec.NewCodecFuncMap[opt.CodecType]
+	if f == nil {
+		return reject(Errorf(CodeInvalidArgument, "rpc server: invalid codec type %s, supported: %s", opt.CodecType, supportedCodecs()))
+	}
+	if opt.Version == 0 {
+		return f
+	}
+
+	server.mu.Lock()
+	auth := server.auth
+	server.mu.Unlock()
+	if auth != nil && !opt.Auth {
+		return reject(errUnauthenticated)
+	}
+
+	ack := &HandshakeAck{
+		Version:      ProtocolVersion,
+		CodecType:    opt.CodecType,
+		Capabilities: []string{CapStreaming, CapMetadata, CapBatch, CapNotify, CapReverse},
+	}
+	// speak the version of older clients, codecs without
+	// a marshaler are not framed
+	if opt.Version < ack.Version {
+		ack.Version = opt.Version
+	}
+	if ack.Version >= framedVersion && newCodecFunc(opt.CodecType, ack.Version) == nil {
+		ack.Version = framedVersion - 1
+	}
+	// only frames can be compressed
+	if ack.Version >= framedVersion {
+		ack.Capabilities = append(ack.Capabilities, CapCompression)
+		if codec.CompressorMap[opt.Compression] != nil {
+			ack.Compression = opt.Compression
+		}
+	}
+	if auth != nil {
+		ack.Capabilities = append(ack.Capabilities, CapAuth)
+	}
+	if err := writeJSON(conn, ack); err != nil {
+		log.Println("rpc server: handshake ack error:", err)
+		return nil
+	}
+	return withCompression(newCodecFunc(opt.CodecType, ack.Version), ack.Compression, opt.CompressThreshold)
+}
+
+// readAckWithin reads the ack of server on conn within the ack timeout
+// of opt, it fails with errNoAck if server sends nothing
+func readAckWithin(conn net.Conn, dec *json.Decoder, opt *Option) (*HandshakeAck, error) {
+	d := opt.AckTimeout
+	if d == 0 {
+		d = DefaultAckTimeout
+	}
+	if d > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(d))
+		defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	}
+	ack, err := readHandshakeAck(dec)
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() && dec.InputOffset() == 0 {
+		if buffered, _ := io.ReadAll(dec.Buffered()); len(buffered) == 0 {
+			return nil, errNoAck
+		}
+	}
+	return ack, err
+}
+
+// readHandshakeAck reads the ack of server, it returns the error of
+// server if the connection is rejected
+func readHandshakeAck(dec *json.Decoder) (*HandshakeAck, error) {
+	ack := new(HandshakeAck)
+	if err := dec.Decode(ack); err != nil {
+		return nil, fmt.Errorf("rpc client: read handshake ack error: %w", err)
+	}
+	if ack.Error != "" {
+		return nil, NewError(ack.Code, ack.Error)
+	}
+	return ack, nil
+}
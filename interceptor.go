@@ -0,0 +1,116 @@
+package simplerpc
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"runtime"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+// ServerInfo describes the call wrapped by a ServerInterceptor
+type ServerInfo struct {
+	ServiceMethod string        // format "<service>.<method>"
+	Header        *codec.Header // header of request
+}
+
+// Handler invokes the service method with argv and fills reply
+type Handler func(ctx context.Context, argv, reply interface{}) error
+
+// ServerInterceptor wraps the invocation of a service method. It gets the
+// decoded argv and the reply to be sent, and must call next to continue
+// the invocation, the error it returns is sent to client.
+type ServerInterceptor func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error
+
+// Use adds interceptors to server, they are called in the order they are added
+func (server *Server) Use(interceptors ...ServerInterceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	// copy on write, so that running requests keep their chain
+	chain := make([]ServerInterceptor, 0, len(server.interceptors)+len(interceptors))
+	chain = append(chain, server.interceptors...)
+	server.interceptors = append(chain, interceptors...)
+}
+
+// Use adds interceptors to the DefaultServer.
+func Use(interceptors ...ServerInterceptor) { DefaultServer.Use(interceptors...) }
+
+// invoke calls the method of req through server's interceptors, a
+// panic of them or of authorization is recovered as a CodePanic error,
+// like the panic of method which is recovered by service.call
+func (server *Server) invoke(req *request) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("rpc server: %s panic: %v\n%s", req.h.ServiceMethod, r, buf)
+			err = Errorf(CodePanic, "rpc server: %s panic: %v", req.h.ServiceMethod, r)
+		}
+	}()
+	// interceptors can't see or bypass a call which isn't allowed
+	if err := server.authorize(req); err != nil {
+		return err
+	}
+	server.mu.Lock()
+	interceptors := server.interceptors
+	server.mu.Unlock()
+
+	handler := func(ctx context.Context, argv, reply interface{}) error {
+		return req.svc.call(ctx, req.mtype, reflect.ValueOf(argv), reflect.ValueOf(reply))
+	}
+	info := &ServerInfo{ServiceMethod: req.h.ServiceMethod, Header: req.h}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, argv, reply interface{}) error {
+			return interceptor(ctx, info, argv, reply, next)
+		}
+	}
+	// a bidi streaming method has no reply
+	var reply interface{}
+	if req.replyv.IsValid() {
+		reply = req.replyv.Interface()
+	}
+	return handler(req.ctx, req.argv.Interface(), reply)
+}
+
+// Invoker sends a call to server and waits for it to complete
+type Invoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// ClientInterceptor wraps Client.Call, Client.Go and Client.Notify,
+// whose reply is nil. It can inspect or replace the service method,
+// args and ctx, and must call invoker to continue the call, the error
+// it returns is returned to the caller.
+type ClientInterceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error
+
+// Use adds interceptors to client, they are called in the order they are added
+func (client *Client) Use(interceptors ...ClientInterceptor) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	// copy on write, so that running calls keep their chain
+	chain := make([]ClientInterceptor, 0, len(client.interceptors)+len(interceptors))
+	chain = append(chain, client.interceptors...)
+	client.interceptors = append(chain, interceptors...)
+}
+
+// hasInterceptors return true if client has any interceptor
+func (client *Client) hasInterceptors() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return len(client.interceptors) > 0
+}
+
+// intercept wraps invoker with client's interceptors
+func (client *Client) intercept(invoker Invoker) Invoker {
+	client.mu.Lock()
+	interceptors := client.interceptors
+	client.mu.Unlock()
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
@@ -0,0 +1,102 @@
+package simplerpc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+// default limits of SizeLimits
+const (
+	DefaultMaxHeaderSize = 1 << 20  // 1MB
+	DefaultMaxBodySize   = 32 << 20 // 32MB
+)
+
+// SizeLimits bounds the encoded size of headers and bodies read from a
+// connection, 0 means the default limit and a negative size means no
+// limit. A header beyond it closes the connection. A body beyond it
+// fails with CodeResourceExhausted, and closes the connection as well
+// unless the codec is framed, which skips the body.
+type SizeLimits struct {
+	MaxHeaderSize int
+	MaxBodySize   int
+}
+
+// sizes returns the limits of header and body set on codecs,
+// where 0 means no limit
+func (l SizeLimits) sizes() (int, int) {
+	return limitSize(l.MaxHeaderSize, DefaultMaxHeaderSize), limitSize(l.MaxBodySize, DefaultMaxBodySize)
+}
+
+func limitSize(n, def int) int {
+	switch {
+	case n == 0:
+		return def
+	case n < 0:
+		return 0
+	}
+	return n
+}
+
+// apply sets the limits on cc if its codec bounds what it reads
+func (l SizeLimits) apply(cc codec.Codec) {
+	if lim, ok := cc.(codec.Limiter); ok {
+		lim.SetLimits(l.sizes())
+	}
+}
+
+// SetSizeLimits sets the limits of messages read by server,
+// connections which are being served keep their limits
+func (server *Server) SetSizeLimits(limits SizeLimits) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.limits = limits
+}
+
+// SetSizeLimits sets the limits of messages read by the DefaultServer.
+func SetSizeLimits(limits SizeLimits) { DefaultServer.SetSizeLimits(limits) }
+
+func (server *Server) sizeLimits() SizeLimits {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.limits
+}
+
+// unreadBodyError is the error of a body which is too large and left
+// on the connection, the connection is closed once it's sent
+type unreadBodyError struct {
+	err *Error
+}
+
+func (e *unreadBodyError) Error() string { return e.err.Error() }
+
+func (e *unreadBodyError) Unwrap() error { return e.err }
+
+// readBodyError returns the error sent for a body which can't be read
+func readBodyError(err error) error {
+	msg := "rpc server: read body error: " + err.Error()
+	if !errors.Is(err, codec.ErrTooLarge) {
+		return NewError(CodeInvalidArgument, msg)
+	}
+	// framed codecs skip the body, so only the call fails
+	var de *codec.DecodeError
+	if errors.As(err, &de) {
+		return NewError(CodeResourceExhausted, msg)
+	}
+	return &unreadBodyError{err: NewError(CodeResourceExhausted, msg)}
+}
+
+// bodyLeft reports whether err leaves a body unread on the connection
+func bodyLeft(err error) bool {
+	var ue *unreadBodyError
+	return errors.As(err, &ue)
+}
+
+// sizeText formats a limit of codecs for the debug page
+func sizeText(n int) string {
+	if n == 0 {
+		return "no limit"
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
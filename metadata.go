@@ -0,0 +1,114 @@
+package simplerpc
+
+import (
+	"context"
+	"sync"
+)
+
+// Metadata is string key/value pairs sent in the header of request
+// and response, such as trace ids, auth tokens or caller names
+type Metadata map[string]string
+
+// Copy returns a copy of md
+func (md Metadata) Copy() Metadata {
+	out := make(Metadata, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+type (
+	outgoingMetadataKey struct{}
+	incomingMetadataKey struct{}
+	responseMetadataKey struct{}
+	readMetadataKey     struct{}
+)
+
+// NewOutgoingContext attaches md to ctx, md is sent to server
+// with the calls made with the returned ctx
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingMetadataKey{}, md)
+}
+
+// FromOutgoingContext returns the metadata that will be sent with ctx
+func FromOutgoingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(outgoingMetadataKey{}).(Metadata)
+	return md, ok
+}
+
+// FromIncomingContext returns the metadata sent by the caller,
+// ctx is the one passed to service method or server interceptor
+func FromIncomingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(incomingMetadataKey{}).(Metadata)
+	return md, ok
+}
+
+// responseMetadata collects metadata set by handler
+type responseMetadata struct {
+	mu sync.Mutex // protect following
+	md Metadata
+}
+
+// newIncomingContext attaches the metadata of request to ctx and
+// prepares the metadata of response
+func newIncomingContext(ctx context.Context, md Metadata) context.Context {
+	if md == nil {
+		md = Metadata{}
+	}
+	ctx = context.WithValue(ctx, incomingMetadataKey{}, md)
+	return context.WithValue(ctx, responseMetadataKey{}, &responseMetadata{})
+}
+
+// SetResponseMetadata sets key to value in the metadata of response,
+// ctx is the one passed to service method or server interceptor
+func SetResponseMetadata(ctx context.Context, key, value string) bool {
+	rm, ok := ctx.Value(responseMetadataKey{}).(*responseMetadata)
+	if !ok {
+		return false
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.md == nil {
+		rm.md = make(Metadata)
+	}
+	rm.md[key] = value
+	return true
+}
+
+// responseMetadataFrom returns the metadata of response set in ctx
+func responseMetadataFrom(ctx context.Context) Metadata {
+	rm, ok := ctx.Value(responseMetadataKey{}).(*responseMetadata)
+	if !ok {
+		return nil
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.md == nil {
+		return nil
+	}
+	return rm.md.Copy()
+}
+
+// CallOption configures a single Client.Call
+type CallOption func(ctx context.Context) context.Context
+
+// WithMetadata sends md with the call, it is merged with the
+// metadata attached by NewOutgoingContext
+func WithMetadata(md Metadata) CallOption {
+	return func(ctx context.Context) context.Context {
+		out, _ := FromOutgoingContext(ctx)
+		out = out.Copy()
+		for k, v := range md {
+			out[k] = v
+		}
+		return NewOutgoingContext(ctx, out)
+	}
+}
+
+// ReadMetadata stores the metadata of response into md after the call
+func ReadMetadata(md *Metadata) CallOption {
+	return func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, readMetadataKey{}, md)
+	}
+}
@@ -0,0 +1,71 @@
+package simplerpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+)
+
+// Peer describes the client which sends a request, it's read from
+// the ctx of handlers and server interceptors by PeerFromContext
+type Peer struct {
+	Addr     net.Addr // remote address, nil if the connection has none
+	Identity string   // identity of client given by the authenticator of server
+	// following are set only if the connection is TLS and the
+	// certificate of client is verified by server (mutual TLS)
+	Certificate *x509.Certificate // verified certificate of client
+	Subject     pkix.Name         // subject of Certificate
+	SANs        []string          // DNS names, IPs, URIs and emails of Certificate
+}
+
+// Authenticated return true if the certificate of peer is verified
+// or the authenticator of server has accepted it
+func (p *Peer) Authenticated() bool {
+	return p.Certificate != nil || p.Identity != ""
+}
+
+// newPeer get the peer on the other side of conn, it completes
+// the handshake if conn is TLS
+func newPeer(conn io.ReadWriteCloser) (*Peer, error) {
+	p := new(Peer)
+	if c, ok := conn.(net.Conn); ok {
+		p.Addr = c.RemoteAddr()
+	}
+	c, ok := conn.(*tls.Conn)
+	if !ok {
+		return p, nil
+	}
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	// certificate of client is trusted only if it has been verified
+	state := c.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return p, nil
+	}
+	cert := state.VerifiedChains[0][0]
+	p.Certificate = cert
+	p.Subject = cert.Subject
+	p.SANs = append(p.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		p.SANs = append(p.SANs, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		p.SANs = append(p.SANs, uri.String())
+	}
+	p.SANs = append(p.SANs, cert.EmailAddresses...)
+	return p, nil
+}
+
+// PeerFromContext returns the peer which sends the request of ctx,
+// it's only available on server
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	sc, ok := ctx.Value(peerKey{}).(*serverConn)
+	if !ok || sc.remote == nil {
+		return nil, false
+	}
+	return sc.remote, true
+}
@@ -0,0 +1,120 @@
+package simplerpc
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Policy authorizes identities of clients to call service methods.
+// Patterns are matched as a whole, '*' matches any sequence of
+// characters, eg "Arith.*", "*.Get*" or "*". The identity of a peer
+// is Peer.Identity, or the common name of its verified certificate,
+// unauthenticated peers have an empty identity which only "*" matches.
+//
+// A policy file is the JSON of Policy, eg
+//
+//	{
+//		"roles": {"reader": ["Arith.Get*"], "admin": ["*"]},
+//		"identities": {"billing": ["reader"], "ops-*": ["admin"]}
+//	}
+type Policy struct {
+	Roles      map[string][]string `json:"roles"`      // patterns of service methods allowed to each role
+	Identities map[string][]string `json:"identities"` // roles of the identities which match each pattern
+}
+
+// LoadPolicy reads a policy from the JSON file at path
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Policy)
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Allow return true if identity is allowed to call serviceMethod
+func (p *Policy) Allow(identity, serviceMethod string) bool {
+	for pattern, roles := range p.Identities {
+		if !matchPattern(pattern, identity) {
+			continue
+		}
+		for _, role := range roles {
+			for _, method := range p.Roles[role] {
+				if matchPattern(method, serviceMethod) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// matchPattern return true if s matches pattern, where '*' matches
+// any sequence of characters
+func matchPattern(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	// first and last parts are anchored to the ends of s
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// SetPolicy swaps the authorization policy of server, it applies to
+// requests which arrive after it's set. nil means every call is allowed.
+func (server *Server) SetPolicy(p *Policy) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.policy = p
+}
+
+// SetPolicy swaps the authorization policy of DefaultServer
+func SetPolicy(p *Policy) { DefaultServer.SetPolicy(p) }
+
+// LoadPolicyFile reads the policy file at path and swaps it in, the
+// old policy is kept if the file can't be loaded
+func (server *Server) LoadPolicyFile(path string) error {
+	p, err := LoadPolicy(path)
+	if err != nil {
+		return err
+	}
+	server.SetPolicy(p)
+	return nil
+}
+
+// authorize checks the policy of server for req before it's handled
+func (server *Server) authorize(req *request) error {
+	server.mu.Lock()
+	p := server.policy
+	server.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+
+	var identity string
+	if peer, ok := PeerFromContext(req.ctx); ok {
+		identity = peer.Identity
+		if identity == "" && peer.Certificate != nil {
+			identity = peer.Subject.CommonName
+		}
+	}
+	if !p.Allow(identity, req.h.ServiceMethod) {
+		return Errorf(CodePermissionDenied, "rpc server: %q is not allowed to call %s", identity, req.h.ServiceMethod)
+	}
+	return nil
+}
@@ -1,7 +1,7 @@
 package simplerpc
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"log"
 	"reflect"
@@ -13,10 +13,14 @@ import (
 
 // request stores all information of a call
 type request struct {
-	h            *codec.Header // header of request
-	mtype        *methodType   // request method type
-	svc          *service      // request service
-	argv, replyv reflect.Value // argv and replyv of request
+	h            *codec.Header      // header of request
+	mtype        *methodType        // request method type
+	svc          *service           // request service
+	argv, replyv reflect.Value      // argv and replyv of request
+	ctx          context.Context    // ctx passed to the method
+	cancel       context.CancelFunc // cancel ctx when request done or client cancels it
+	timeout      time.Duration      // effective handle timeout, 0 means no limit
+	stream       *serverStream      // stream of a streaming method
 }
 
 // readRequestHeader read request header by codec
@@ -33,24 +37,53 @@ func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	return &h, nil
 }
 
-// readRequest read request body by codec
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
-	// get base info from header
-	h, err := server.readRequestHeader(cc)
-	if err != nil {
-		return nil, err
-	}
+// readRequest read request body of h by codec
+func (server *Server) readRequest(cc codec.Codec, h *codec.Header) (*request, error) {
+	var err error
 	req := &request{h: h}
 
+	switch h.Kind {
+	case codec.KindCall, codec.KindNotify:
+	case codec.KindCancel:
+		// cancel message only has an empty body
+		if err = cc.ReadBody(nil); err != nil {
+			return nil, err
+		}
+		return req, nil
+	default:
+		// bodies of batch are read by serveBatch,
+		// body of stream message is read by receiveStream
+		return req, nil
+	}
+	return server.readRequestBody(cc, req)
+}
+
+// readRequestBody find the method of req and read its argv by codec
+func (server *Server) readRequestBody(cc codec.Codec, req *request) (*request, error) {
+	var err error
+	h := req.h
+
 	// get service from server
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
+		// discard body so that the next request can be read
+		if rerr := cc.ReadBody(nil); rerr != nil {
+			return nil, rerr
+		}
 		return req, err
 	}
 	// build request parma
 	req.argv = req.mtype.newArgv()
 	req.replyv = req.mtype.newReplyv()
 
+	// messages of a client stream follow the request, its body is empty
+	if req.mtype.stream&streamRecv != 0 {
+		if err = cc.ReadBody(nil); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+
 	// make sure that argvi is a pointer, ReadBody need a pointer as parameter
 	argvi := req.argv.Interface()
 	if req.argv.Type().Kind() != reflect.Ptr {
@@ -58,7 +91,7 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	}
 	if err = cc.ReadBody(argvi); err != nil {
 		log.Println("rpc server: read body err:", err)
-		return req, err
+		return req, readBodyError(err)
 	}
 	return req, nil
 }
@@ -72,38 +105,109 @@ func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interfa
 	}
 }
 
-// handleRequest handle request
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
+// newRequestContext build the ctx of req, the effective handle timeout
+// becomes the deadline of ctx and the metadata of request can be
+// read from ctx, as well as the client of the peer on sc
+func newRequestContext(sc *serverConn, req *request) {
+	ctx := newIncomingContext(context.Background(), req.h.Metadata)
+	ctx = context.WithValue(ctx, peerKey{}, sc)
+	if req.timeout > 0 {
+		req.ctx, req.cancel = context.WithTimeout(ctx, req.timeout)
+		return
+	}
+	req.ctx, req.cancel = context.WithCancel(ctx)
+}
 
-	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		called <- struct{}{}
+// responseHeader builds the header of response to req, a new header
+// is used so that a late handler never races with the sent response.
+// the response of a streaming method is the end of stream.
+func (req *request) responseHeader() *codec.Header {
+	h := &codec.Header{
+		ServiceMethod: req.h.ServiceMethod,
+		Seq:           req.h.Seq,
+		Kind:          codec.KindCall,
+	}
+	if req.stream != nil {
+		req.stream.close()
+		h.Kind = codec.KindStreamEnd
+	}
+	return h
+}
+
+// sendError send err as the response of req
+func (server *Server) sendError(sc *serverConn, req *request, err error) {
+	if req.h.Kind == codec.KindNotify {
+		log.Printf("rpc server: notify %s error: %v", req.h.ServiceMethod, err)
+		return
+	}
+	h := req.responseHeader()
+	setHeaderError(h, err)
+	server.sendResponse(sc.cc, h, invalidRequest, sc.sending)
+}
+
+// sendResult send the result of the handler as the response of req
+func (server *Server) sendResult(sc *serverConn, req *request, err error) {
+	if req.h.Kind == codec.KindNotify {
 		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
-			sent <- struct{}{}
-			return
+			log.Printf("rpc server: notify %s error: %v", req.h.ServiceMethod, err)
 		}
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
-		sent <- struct{}{}
+		return
+	}
+	// a stream failed by server ends with its error
+	if req.stream != nil {
+		if serr := req.stream.failure(); serr != nil {
+			err = serr
+		}
+	}
+	h := req.responseHeader()
+	h.Metadata = responseMetadataFrom(req.ctx)
+	if err != nil {
+		setHeaderError(h, err)
+		server.sendResponse(sc.cc, h, invalidRequest, sc.sending)
+		return
+	}
+	// messages of a server stream have been sent, only end it
+	if !req.replyv.IsValid() || req.mtype.stream&streamSend != 0 {
+		server.sendResponse(sc.cc, h, invalidRequest, sc.sending)
+		return
+	}
+	server.sendResponse(sc.cc, h, req.replyv.Interface(), sc.sending)
+}
+
+// handleRequest handle request of sc, exactly one response is sent
+// for req. If the handle timeout expires first, the timeout error is
+// sent, ctx of the handler is cancelled and its late result is dropped.
+func (server *Server) handleRequest(sc *serverConn, req *request) {
+	defer sc.wg.Done()
+	// ctx is cancelled once the request is finished
+	defer func() {
+		sc.calls.Delete(req.h.Seq)
+		req.cancel()
 	}()
 
-	// if timeout is zero, waiting until sent msg success
+	// if timeout is zero, waiting until the handler returns
+	timeout := req.timeout
 	if timeout == 0 {
-		<-called
-		<-sent
+		server.sendResult(sc, req, server.invoke(req))
 		return
 	}
 
-	// if timeout return a timeout msg
+	// buffered, so that a late handler can return without blocking,
+	// it's tracked by sc.wg so that Shutdown waits until it returns
+	done := make(chan error, 1)
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		done <- server.invoke(req)
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
 	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
-	case <-called:
-		<-sent
+	case err := <-done:
+		server.sendResult(sc, req, err)
+	case <-t.C:
+		req.cancel()
+		server.sendError(sc, req, Errorf(CodeDeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout))
 	}
 }
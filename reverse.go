@@ -0,0 +1,78 @@
+package simplerpc
+
+import (
+	"context"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+// reverseCodec marks the messages of calls which server makes on
+// client, so that they are told apart from the calls of client
+type reverseCodec struct {
+	codec.Codec
+}
+
+func (c reverseCodec) Write(h *codec.Header, body interface{}) error {
+	rh := *h
+	rh.Reverse = true
+	return c.Codec.Write(&rh, body)
+}
+
+// Close does nothing, the connection is closed by its owner
+func (c reverseCodec) Close() error {
+	return nil
+}
+
+type peerKey struct{}
+
+// PeerClient returns a client to call the services of the peer which
+// sent the request of ctx, calls are sent over the same connection.
+// On server it calls the services registered by Client.Register,
+// on client it's the client itself.
+func PeerClient(ctx context.Context) (*Client, bool) {
+	sc, ok := ctx.Value(peerKey{}).(*serverConn)
+	if !ok {
+		return nil, false
+	}
+	return sc.peerClient(), true
+}
+
+// Register publishes the receiver's methods in client, so that
+// server can call them with the client returned by PeerClient
+func (client *Client) Register(rcvr interface{}) error {
+	return client.server.Register(rcvr)
+}
+
+// peerClient returns the client of the peer on sc, its responses
+// are read by the serve loop of sc instead of Client.receive
+func (sc *serverConn) peerClient() *Client {
+	sc.peerMu.Lock()
+	defer sc.peerMu.Unlock()
+	if sc.peer == nil {
+		sc.peer = &Client{
+			seq:     1, // seq starts with 1, 0 means invalid call
+			cc:      reverseCodec{sc.cc},
+			opt:     sc.opt,
+			sending: sc.sending,
+			pending: make(map[uint64]*Call),
+		}
+	}
+	return sc.peer
+}
+
+// receiveReverse reads a response of the calls made on the peer of sc
+func (sc *serverConn) receiveReverse(h *codec.Header) error {
+	sc.peerMu.Lock()
+	peer := sc.peer
+	sc.peerMu.Unlock()
+	if peer == nil {
+		// no call has been made on the peer
+		return sc.cc.ReadBody(nil)
+	}
+	return peer.receiveResponse(h)
+}
+
+// closePeer fails the pending calls made on the peer of sc with err
+func (sc *serverConn) closePeer(err error) {
+	sc.peerClient().terminateCalls(err)
+}
@@ -0,0 +1,51 @@
+package simplerpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+type Agent struct {
+	name string
+}
+
+func (a *Agent) Exec(cmd string, reply *string) error {
+	*reply = a.name + " ran " + cmd
+	return nil
+}
+
+type Control int
+
+// Push runs cmd on the agent which calls Push
+func (c Control) Push(ctx context.Context, cmd string, reply *string) error {
+	peer, ok := PeerClient(ctx)
+	if !ok {
+		return errors.New("no peer")
+	}
+	return peer.Call(ctx, "Agent.Exec", cmd, reply)
+}
+
+func TestPeerClient(t *testing.T) {
+	t.Parallel()
+	var c Control
+	l, _ := net.Listen("tcp", ":0")
+	server := NewServer()
+	_ = server.Register(&c)
+	go server.Accept(l)
+
+	for _, name := range []string{"agent-1", "agent-2"} {
+		client, _ := Dial("tcp", l.Addr().String())
+		_ = client.Register(&Agent{name: name})
+		var reply string
+		err := client.Call(context.Background(), "Control.Push", "uptime", &reply)
+		_assert(err == nil && reply == name+" ran uptime", "expect %s to run the command, got %q %v", name, reply, err)
+	}
+
+	// the error of client's service goes back through server
+	client, _ := Dial("tcp", l.Addr().String())
+	var reply string
+	err := client.Call(context.Background(), "Control.Push", "uptime", &reply)
+	_assert(ErrorCode(err) == CodeNotFound, "expect Agent not found on client, got %v", err)
+}
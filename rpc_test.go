@@ -3,9 +3,11 @@ package simplerpc
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -13,7 +15,7 @@ import (
 
 func startServer(addrCh chan string) {
 	var foo Foo
-	l, _ := net.Listen("tcp", ":9999")
+	l, _ := net.Listen("tcp", ":0")
 	_ = Register(&foo)
 	HandleHTTP()
 	addrCh <- l.Addr().String()
@@ -48,6 +50,26 @@ func TestMain(t *testing.T) {
 	fmt.Println("start")
 	log.SetFlags(0)
 	ch := make(chan string, 1)
-	go call(ch)
-	startServer(ch)
+	go startServer(ch)
+	call(ch)
+}
+
+func TestOptionEnd(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"\nabc", "abc"},
+		{" \t\r\nabc", "abc"},
+		{"\n\nabc", "\nabc"},
+		{"abc", "abc"},
+		// no newline after the option, whitespace is the stream
+		{"\tabc", "\tabc"},
+		{"\r\x01", "\r\x01"},
+		{" ", " "},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		b, err := io.ReadAll(&optionEnd{r: strings.NewReader(tt.in)})
+		_assert(err == nil && string(b) == tt.out, "%q: expect %q, got %q, %v", tt.in, tt.out, b, err)
+	}
 }
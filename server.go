@@ -1,6 +1,9 @@
 package simplerpc
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io"
@@ -15,12 +18,40 @@ import (
 
 const MagicNumber = 0x3bef5c
 
-// Option connect rpc option
+// Option connect rpc option, client sends it as a line of JSON
 type Option struct {
 	MagicNumber    int           // MagicNumber means this is a rpc request
 	CodecType      codec.Type    // client can choose different Codec to encode body
 	ConnectTimeout time.Duration // 0 means no limit
 	HandleTimeout  time.Duration
+	// Interceptors wrap every Call and Go of clients dialed with this option,
+	// they stay on the client side and are not sent to the server
+	Interceptors []ClientInterceptor `json:"-"`
+	// TLSConfig makes clients dialed with this option connect over TLS,
+	// ServerName is taken from the dialed address if it's empty
+	TLSConfig *tls.Config `json:"-"`
+	// Credentials answers the challenge of server in the handshake
+	Credentials CredentialsProvider `json:"-"`
+	// Auth tells server that client answers its challenge, it's set
+	// by client if Credentials is not nil
+	Auth bool
+	// Version is the protocol version of client, it's set by client
+	Version int
+	// LegacyHandshake makes client talk to servers which are older
+	// than HandshakeAck, it doesn't wait for the ack
+	LegacyHandshake bool `json:"-"`
+	// AckTimeout is how long client waits for HandshakeAck, 0 means
+	// DefaultAckTimeout and a negative timeout means no limit. If server
+	// sends nothing within it, client falls back to LegacyHandshake
+	// unless it must authenticate, which such servers can't do.
+	AckTimeout time.Duration `json:"-"`
+	// Compression compresses bodies of at least CompressThreshold bytes
+	// both ways, such as codec.Gzip, if server supports it as well.
+	// CompressThreshold 0 means 1KB.
+	Compression       codec.Compression
+	CompressThreshold int
+	// Limits bounds the responses read by clients dialed with this option
+	Limits SizeLimits `json:"-"`
 }
 
 var DefaultOption = &Option{
@@ -29,11 +60,27 @@ var DefaultOption = &Option{
 	ConnectTimeout: time.Second * 10,
 }
 
-// Server represents an RPC Server.
+// Server represents an RPC Server. A connection is closed if its
+// handshake, which is TLS, option, ack and authentication, takes longer
+// than DefaultHandshakeTimeout, servers used to wait for it forever,
+// see SetHandshakeTimeout to change or remove the limit.
 type Server struct {
-	serviceMap sync.Map // service map
+	serviceMap       sync.Map   // service map
+	mu               sync.Mutex // protect following
+	listeners        map[net.Listener]struct{}
+	conns            map[*serverConn]struct{}
+	shutdown         bool                // Shutdown has been called
+	interceptors     []ServerInterceptor // wrap every invocation of service method
+	timeouts         TimeoutPolicy       // handle timeout enforced by server
+	auth             Authenticator       // validates credentials of clients, nil accepts all
+	policy           *Policy             // authorizes calls of clients, nil allows all
+	limits           SizeLimits          // bounds the messages read from clients
+	handshakeTimeout time.Duration       // time a client has to complete the handshake
 }
 
+// errServerShutdown is returned for calls which arrive after Shutdown
+var errServerShutdown = NewError(CodeUnavailable, "rpc server: server is shutting down")
+
 // NewServer returns a new Server.
 func NewServer() *Server {
 	return &Server{}
@@ -45,11 +92,19 @@ var DefaultServer = NewServer()
 // Accept accepts connections on the listener and serves requests
 // for each incoming connection.
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
+
 	for {
 		// listen connect until the connect arrive
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error:", err)
+			if !server.isShutdown() {
+				log.Println("rpc server: accept error:", err)
+			}
 			return
 		}
 
@@ -62,67 +117,362 @@ func (server *Server) Accept(lis net.Listener) {
 // for each incoming connection.
 func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
 
+// AcceptTLS accepts connections on the listener and serves requests
+// over TLS with config for each incoming connection.
+func (server *Server) AcceptTLS(lis net.Listener, config *tls.Config) {
+	server.Accept(tls.NewListener(lis, config))
+}
+
+// AcceptTLS accepts connections on the listener and serves requests
+// over TLS with config for each incoming connection.
+func AcceptTLS(lis net.Listener, config *tls.Config) { DefaultServer.AcceptTLS(lis, config) }
+
+// isShutdown return true if Shutdown has been called
+func (server *Server) isShutdown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.shutdown
+}
+
 // ServeConn runs the server on a single connection.
 // ServeConn blocks, serving the connection until the client hangs up.
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	// close connect when serve end
 	defer func() { _ = conn.Close() }()
 
+	// a client which sends nothing can't hold the connection forever
+	clearDeadline := server.handshakeDeadline(conn)
+
+	// who is on the other side, the TLS handshake is done here
+	// so that the certificate of client is verified before serving
+	remote, err := newPeer(conn)
+	if err != nil {
+		log.Println("rpc server: tls handshake error:", err)
+		return
+	}
+
 	// get request header
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
 		log.Println("rpc server: options error: ", err)
 		return
 	}
 
-	// check if this request is rpc request
-	if opt.MagicNumber != MagicNumber {
-		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
+	// check option and tell client whether it's accepted
+	f := server.handshake(conn, &opt)
+	if f == nil {
 		return
 	}
-
-	// get corresponding codec to decode body
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
-		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
+	if !server.authenticate(conn, dec, &opt, f, remote) {
 		return
 	}
-	server.serveCodec(f(conn), &opt)
+	// the decoder may have read ahead the first request, so the codec
+	// reads the buffered bytes before reading from conn
+	r := &optionEnd{r: io.MultiReader(dec.Buffered(), conn)}
+	clearDeadline()
+	server.serveCodec(f(&bufferedConn{r, conn}), &opt, remote)
+}
+
+// optionEnd drops the end of the option line, or of the credentials
+// line which follows it, when r is first read, which is whitespace up
+// to a newline. Bytes which don't end with a newline are kept, they are
+// the stream of a client which doesn't end the line with a newline,
+// such as with json.Marshal. It's read lazily so that server never
+// waits for a newline which isn't sent.
+type optionEnd struct {
+	r    io.Reader
+	done bool
+}
+
+func (o *optionEnd) Read(p []byte) (int, error) {
+	if !o.done {
+		o.done = true
+		o.r = io.MultiReader(bytes.NewReader(o.lineEnd()), o.r)
+	}
+	return o.r.Read(p)
+}
+
+// lineEnd reads whitespace up to a newline, it returns the bytes read
+// if they aren't such a line end, so that they are read by the codec
+func (o *optionEnd) lineEnd() []byte {
+	var b []byte
+	c := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(o.r, c); err != nil {
+			return b
+		}
+		switch c[0] {
+		case '\n':
+			return nil
+		case ' ', '\t', '\r':
+			b = append(b, c[0])
+		default:
+			return append(b, c[0])
+		}
+	}
+}
+
+// bufferedConn reads from r instead of the wrapped connection
+type bufferedConn struct {
+	r io.Reader
+	io.ReadWriteCloser
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
 }
 
 // invalidRequest is a placeholder for response argv when error occurs
 var invalidRequest = struct{}{}
 
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
-	sending := new(sync.Mutex) // make sure to send a complete response
-	wg := new(sync.WaitGroup)  // wait until all request are handled
+// serverConn stores the state of a connection served by server
+type serverConn struct {
+	cc      codec.Codec
+	opt     *Option
+	remote  *Peer          // the peer which sends requests, nil on client
+	sending *sync.Mutex    // make sure to send a complete response
+	wg      sync.WaitGroup // wait until all request are handled
+	calls   sync.Map       // cancel func of running requests by Seq
+	streams sync.Map       // *serverStream of running streaming requests by Seq
+	peerMu  sync.Mutex     // protect following
+	peer    *Client        // calls services of the peer, created on first use
+}
 
-	for {
-		// decode request by codec
-		req, err := server.readRequest(cc)
+func (server *Server) serveCodec(cc codec.Codec, opt *Option, remote *Peer) {
+	sc := &serverConn{cc: cc, opt: opt, remote: remote, sending: new(sync.Mutex)}
+	server.sizeLimits().apply(cc)
+	if !server.trackConn(sc, true) {
+		_ = cc.Close()
+		return
+	}
+	defer server.trackConn(sc, false)
 
-		// if get err return a err response
-		if err != nil {
-			if req == nil {
-				// it's not possible to recover, so close the connection
-				break
+	var err error
+	for err == nil {
+		var h *codec.Header
+		if h, err = server.readRequestHeader(cc); err != nil {
+			// the connection is closed, tell client why
+			if errors.Is(err, codec.ErrTooLarge) {
+				h = &codec.Header{}
+				setHeaderError(h, NewError(CodeResourceExhausted, "rpc server: read header error: "+err.Error()))
+				server.sendResponse(cc, h, invalidRequest, sc.sending)
 			}
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+			break
+		}
+		// a response to the call which server made on the peer
+		if h.Reverse {
+			err = sc.receiveReverse(h)
 			continue
 		}
-
-		wg.Add(1)
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		err = server.serveMessage(sc, h)
 	}
 
+	// calls on the peer can't be responded any more
+	sc.closePeer(err)
+
 	// wait all request done
-	wg.Wait()
+	sc.wg.Wait()
 
 	// close connect
 	_ = cc.Close()
 }
 
+// serveMessage reads the body of message h and handles it, it returns
+// an error only if the connection can't be read any more
+func (server *Server) serveMessage(sc *serverConn, h *codec.Header) error {
+	// decode request by codec
+	req, err := server.readRequest(sc.cc, h)
+
+	// if get err return a err response
+	if err != nil {
+		if req == nil {
+			// it's not possible to recover, so close the connection
+			return err
+		}
+		server.sendError(sc, req, err)
+		if bodyLeft(err) {
+			return err
+		}
+		return nil
+	}
+
+	switch req.h.Kind {
+	case codec.KindCancel:
+		// client gives up the call, stop the running handler
+		if cancel, ok := sc.calls.Load(req.h.Seq); ok {
+			cancel.(context.CancelFunc)()
+		}
+	case codec.KindBatch:
+		// several calls in one frame
+		if err = server.serveBatch(sc, req.h); err != nil {
+			log.Println("rpc server: read batch error:", err)
+			return err
+		}
+	case codec.KindCall, codec.KindNotify:
+		server.dispatch(sc, req)
+	default:
+		// a message of a running stream
+		if err = server.receiveStream(sc, req.h); err != nil {
+			log.Println("rpc server: read stream error:", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// dispatch starts handling req in background
+func (server *Server) dispatch(sc *serverConn, req *request) {
+	// no stream can be opened without a response to end it
+	if req.h.Kind == codec.KindNotify && req.mtype.stream != 0 {
+		server.sendError(sc, req, NewError(CodeInvalidArgument, "rpc server: can't notify streaming method "+req.h.ServiceMethod))
+		return
+	}
+
+	// reject new calls once the server is shutting down
+	if !server.addRequest(sc) {
+		server.sendError(sc, req, errServerShutdown)
+		return
+	}
+	req.timeout = server.handleTimeout(req, sc.opt.HandleTimeout)
+	newRequestContext(sc, req)
+	sc.calls.Store(req.h.Seq, req.cancel)
+	// bind the stream before reading its messages
+	if req.mtype.stream != 0 {
+		server.newServerStream(sc, req)
+	}
+	go server.handleRequest(sc, req)
+}
+
+// serveBatch reads the calls of batch h and dispatches them
+// concurrently, each of them is responded as it finishes
+func (server *Server) serveBatch(sc *serverConn, h *codec.Header) error {
+	for i, serviceMethod := range h.Batch {
+		req := &request{h: &codec.Header{
+			ServiceMethod: serviceMethod,
+			Seq:           h.Seq + uint64(i),
+			Kind:          codec.KindCall,
+			Timeout:       h.Timeout,
+			Metadata:      Metadata(h.Metadata).Copy(),
+		}}
+		req, err := server.readRequestBody(sc.cc, req)
+		if err != nil {
+			if req == nil {
+				return err
+			}
+			server.sendError(sc, req, err)
+			if bodyLeft(err) {
+				return err
+			}
+			continue
+		}
+		if req.mtype.stream != 0 {
+			server.sendError(sc, req, NewError(CodeInvalidArgument, "rpc server: can't batch streaming method "+serviceMethod))
+			continue
+		}
+		server.dispatch(sc, req)
+	}
+	return nil
+}
+
+// trackConn add or remove sc from server's active connections,
+// return false if the server is shutting down
+func (server *Server) trackConn(sc *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.conns, sc)
+		return true
+	}
+	if server.shutdown {
+		return false
+	}
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	server.conns[sc] = struct{}{}
+	return true
+}
+
+// trackListener add or remove lis from server's listeners,
+// return false if the server is shutting down
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.shutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+// addRequest add a running request to sc, it holds server.mu
+// so that Shutdown never waits while a new request is added
+func (server *Server) addRequest(sc *serverConn) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.shutdown {
+		return false
+	}
+	sc.wg.Add(1)
+	return true
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners,
+// tells connected clients to stop sending new calls and waits for
+// running requests to finish. If ctx expires first, the remaining
+// requests are cancelled and connections are closed anyway.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.shutdown = true
+	for lis := range server.listeners {
+		_ = lis.Close()
+	}
+	conns := make([]*serverConn, 0, len(server.conns))
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	server.mu.Unlock()
+
+	// tell clients not to send new calls
+	for _, sc := range conns {
+		h := &codec.Header{Kind: codec.KindGoAway}
+		server.sendResponse(sc.cc, h, invalidRequest, sc.sending)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, sc := range conns {
+			sc.wg.Wait()
+		}
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// force close connections, running requests are cancelled
+	for _, sc := range conns {
+		sc.calls.Range(func(_, cancel interface{}) bool {
+			cancel.(context.CancelFunc)()
+			return true
+		})
+		_ = sc.cc.Close()
+	}
+	return err
+}
+
 // Register publishes in the server the set of methods of the
 func (server *Server) Register(rcvr interface{}) error {
 	s := newService(rcvr)
@@ -140,7 +490,7 @@ func (server *Server) findService(serviceMethod string) (svc *service, mtype *me
 	// common request service.Method
 	dot := strings.LastIndex(serviceMethod, ".")
 	if dot < 0 {
-		err = errors.New("rpc server: service/method request ill-formed: " + serviceMethod)
+		err = NewError(CodeInvalidArgument, "rpc server: service/method request ill-formed: "+serviceMethod)
 		return
 	}
 	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
@@ -148,7 +498,7 @@ func (server *Server) findService(serviceMethod string) (svc *service, mtype *me
 	// get service from server
 	svci, ok := server.serviceMap.Load(serviceName)
 	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
+		err = NewError(CodeNotFound, "rpc server: can't find service "+serviceName)
 		return
 	}
 	svc = svci.(*service)
@@ -156,7 +506,7 @@ func (server *Server) findService(serviceMethod string) (svc *service, mtype *me
 	// get method from service
 	mtype = svc.method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server: can't find method " + methodName)
+		err = NewError(CodeNotFound, "rpc server: can't find method "+methodName)
 	}
 	return
 }
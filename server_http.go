@@ -1,8 +1,10 @@
 package simplerpc
 
 import (
+	"crypto/tls"
 	"io"
 	"log"
+	"net"
 	"net/http"
 )
 
@@ -40,6 +42,13 @@ func (server *Server) HandleHTTP() {
 	log.Println("rpc server debug path:", defaultDebugPath)
 }
 
+// ServeHTTPTLS serves HTTP handlers registered by HandleHTTP on lis over
+// TLS with config, clients connect to it by DialHTTP with TLSConfig
+// set or XDial with https@addr
+func ServeHTTPTLS(lis net.Listener, config *tls.Config) error {
+	return http.Serve(tls.NewListener(lis, config), nil)
+}
+
 // HandleHTTP is a convenient approach for default server to register HTTP handlers
 func HandleHTTP() {
 	DefaultServer.HandleHTTP()
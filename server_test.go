@@ -0,0 +1,534 @@
+package simplerpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+func startShutdownServer(t *testing.T) (*Server, string) {
+	var b Bar
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	_ = server.Register(&b)
+	go server.Accept(l)
+	return server, l.Addr().String()
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Parallel()
+	t.Run("drain", func(t *testing.T) {
+		server, addr := startShutdownServer(t)
+		client, _ := Dial("tcp", addr)
+		var reply int
+		call := client.Go("Bar.Timeout", 1, &reply, nil)
+		time.Sleep(time.Millisecond * 100)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		_assert(err == nil, "expect shutdown after draining, got %v", err)
+		call = <-call.Done
+		_assert(call.Error == nil, "expect in-flight call to finish, got %v", call.Error)
+
+		// client has been told to stop sending new calls
+		err = client.Call(context.Background(), "Bar.Timeout", 1, &reply)
+		_assert(errors.Is(err, ErrShutdown), "expect ErrShutdown, got %v", err)
+		_assert(!client.IsAvailable(), "expect client unavailable after shutdown")
+		_, err = Dial("tcp", addr, &Option{ConnectTimeout: time.Second})
+		_assert(err != nil, "expect listener closed")
+	})
+	t.Run("force close", func(t *testing.T) {
+		server, addr := startShutdownServer(t)
+		client, _ := Dial("tcp", addr)
+		var reply int
+		call := client.Go("Bar.Cancel", 1, &reply, nil)
+		time.Sleep(time.Millisecond * 100)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		_assert(errors.Is(err, context.DeadlineExceeded), "expect deadline exceeded, got %v", err)
+		call = <-call.Done
+		_assert(call.Error != nil, "expect in-flight call to fail")
+		<-barCanceled
+	})
+}
+
+func TestServer_Use(t *testing.T) {
+	t.Parallel()
+	server, addr := startShutdownServer(t)
+	var order []string
+	server.Use(func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error {
+		order = append(order, "first "+info.ServiceMethod)
+		return next(ctx, argv, reply)
+	}, func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error {
+		order = append(order, "second")
+		if argv.(int) < 0 {
+			return errors.New("negative argv")
+		}
+		err := next(ctx, argv, reply)
+		*reply.(*time.Duration) = time.Hour
+		return err
+	})
+
+	client, _ := Dial("tcp", addr)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var reply time.Duration
+	err := client.Call(ctx, "Bar.Deadline", 1, &reply)
+	_assert(err == nil && reply == time.Hour, "expect reply set by interceptor, got %v %s", err, reply)
+	_assert(len(order) == 2 && order[0] == "first Bar.Deadline" && order[1] == "second", "wrong interceptor order %v", order)
+
+	err = client.Call(ctx, "Bar.Deadline", -1, &reply)
+	_assert(err != nil && err.Error() == "negative argv", "expect error from interceptor, got %v", err)
+}
+
+func TestServer_InterceptorPanic(t *testing.T) {
+	t.Parallel()
+	server, addr := startShutdownServer(t)
+	server.Use(func(ctx context.Context, info *ServerInfo, argv, reply interface{}, next Handler) error {
+		if argv.(int) < 0 {
+			panic("interceptor panic")
+		}
+		return next(ctx, argv, reply)
+	})
+
+	client, _ := Dial("tcp", addr)
+	var reply int
+	err := client.Call(context.Background(), "Bar.Sleep", -1, &reply)
+	_assert(ErrorCode(err) == CodePanic && strings.Contains(err.Error(), "interceptor panic"), "expect panic of interceptor recovered, got %v", err)
+	err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+	_assert(err == nil && reply == 1, "expect server to keep serving, got %v", err)
+}
+
+// Late tells when its methods return
+type Late struct {
+	returned chan int
+}
+
+func (l *Late) Sleep(ms int, reply *int) error {
+	defer func() { l.returned <- ms }()
+	time.Sleep(time.Millisecond * time.Duration(ms))
+	*reply = ms
+	return nil
+}
+
+func TestServer_HandleTimeout(t *testing.T) {
+	t.Parallel()
+	l, _ := net.Listen("tcp", ":0")
+	late := &Late{returned: make(chan int, 5)}
+	server := NewServer()
+	_ = server.Register(late)
+	go server.Accept(l)
+
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	defer func() { _ = conn.Close() }()
+	_ = json.NewEncoder(conn).Encode(&Option{
+		MagicNumber:   MagicNumber,
+		CodecType:     codec.GobType,
+		HandleTimeout: time.Millisecond * 100,
+	})
+	cc := codec.NewGobCodec(conn)
+	for seq := uint64(1); seq <= 5; seq++ {
+		_ = cc.Write(&codec.Header{ServiceMethod: "Late.Sleep", Seq: seq}, 300)
+	}
+
+	// each Seq gets exactly one response, late results are dropped
+	got := make(map[uint64]int)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(got) < 5 {
+		var h codec.Header
+		if err := cc.ReadHeader(&h); err != nil {
+			break
+		}
+		_ = cc.ReadBody(nil)
+		_assert(Code(h.Code) == CodeDeadlineExceeded, "expect a timeout error, got %q", h.Error)
+		got[h.Seq]++
+	}
+	_assert(len(got) == 5, "expect responses of 5 calls, got %v", got)
+	for seq, n := range got {
+		_assert(n == 1, "expect 1 response of seq %d, got %d", seq, n)
+	}
+	// shutdown drains the late handlers as well
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_assert(server.Shutdown(ctx) == nil, "expect shutdown after draining")
+	_assert(len(late.returned) == 5, "expect late handlers returned before shutdown, got %d", len(late.returned))
+}
+
+func TestServer_TimeoutPolicy(t *testing.T) {
+	t.Parallel()
+	server, addr := startShutdownServer(t)
+	server.SetTimeoutPolicy(TimeoutPolicy{
+		Default:   time.Millisecond * 200,
+		Max:       time.Millisecond * 500,
+		Overrides: map[string]time.Duration{"Bar": time.Millisecond * 100, "Bar.Deadline": time.Second * 3},
+	})
+
+	// default is used when client doesn't ask, the service override caps it
+	client, _ := Dial("tcp", addr)
+	var reply int
+	err := client.Call(context.Background(), "Bar.Sleep", 300, &reply)
+	_assert(ErrorCode(err) == CodeDeadlineExceeded && strings.Contains(err.Error(), "100ms"), "expect 100ms timeout, got %v", err)
+
+	// client can't ask for a longer or unlimited timeout than the policy
+	var d time.Duration
+	err = client.Call(context.Background(), "Bar.Deadline", 1, &d)
+	_assert(err == nil && d > time.Millisecond*100 && d <= time.Millisecond*200, "expect default deadline, got %v %s", err, d)
+	client, _ = Dial("tcp", addr, &Option{HandleTimeout: time.Minute})
+	err = client.Call(context.Background(), "Bar.Deadline", 1, &d)
+	_assert(err == nil && d > time.Millisecond*400 && d <= time.Millisecond*500, "expect method override clamped to max, got %v %s", err, d)
+
+	// the caller's remaining deadline is shorter than policy
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err = client.Call(ctx, "Bar.Deadline", 1, &d)
+	_assert(err == nil && d <= time.Millisecond*50, "expect the caller's deadline, got %v %s", err, d)
+}
+
+func (b Bar) Identity(ctx context.Context, argv int, reply *string) error {
+	p, _ := PeerFromContext(ctx)
+	*reply = p.Identity
+	return nil
+}
+
+func TestServer_Authenticator(t *testing.T) {
+	t.Parallel()
+	server, addr := startShutdownServer(t)
+	secrets := map[string][]byte{"agent-1": []byte("s3cret")}
+	hmacAuth := HMACAuthenticator(func(keyID string) ([]byte, bool) {
+		secret, ok := secrets[keyID]
+		return secret, ok
+	})
+	bearerAuth := BearerAuthenticator(func(ctx context.Context, token string) (string, error) {
+		if !strings.HasPrefix(token, "valid-") {
+			return "", errors.New("invalid token")
+		}
+		return "svc-" + strings.TrimPrefix(token, "valid-"), nil
+	})
+	server.SetAuthenticator(func(ctx context.Context, challenge []byte, creds Credentials) (string, error) {
+		if _, ok := creds["token"]; ok {
+			return bearerAuth(ctx, challenge, creds)
+		}
+		return hmacAuth(ctx, challenge, creds)
+	})
+
+	t.Run("hmac", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{Credentials: HMACCredentials("agent-1", []byte("s3cret"))})
+		_assert(err == nil, "expect client authenticated, got %v", err)
+		var reply string
+		err = client.Call(context.Background(), "Bar.Identity", 1, &reply)
+		_assert(err == nil && reply == "agent-1", "expect identity agent-1, got %q %v", reply, err)
+
+		_, err = Dial("tcp", addr, &Option{Credentials: HMACCredentials("agent-1", []byte("wrong"))})
+		_assert(ErrorCode(err) == CodeUnauthenticated, "expect wrong secret rejected, got %v", err)
+	})
+	t.Run("bearer refreshed on reconnect", func(t *testing.T) {
+		var n int32
+		opt := &Option{Credentials: BearerCredentials(func(ctx context.Context) (string, error) {
+			return fmt.Sprintf("valid-%d", atomic.AddInt32(&n, 1)), nil
+		})}
+		for i := 1; i <= 2; i++ {
+			client, err := Dial("tcp", addr, opt)
+			_assert(err == nil, "expect client authenticated, got %v", err)
+			var reply string
+			err = client.Call(context.Background(), "Bar.Identity", 1, &reply)
+			_assert(err == nil && reply == fmt.Sprintf("svc-%d", i), "expect identity svc-%d, got %q %v", i, reply, err)
+			_ = client.Close()
+		}
+	})
+	t.Run("no credentials", func(t *testing.T) {
+		_, err := Dial("tcp", addr)
+		_assert(ErrorCode(err) == CodeUnauthenticated, "expect Unauthenticated in handshake ack, got %v", err)
+
+		// clients without handshake ack are told by an error frame
+		client, err := Dial("tcp", addr, &Option{LegacyHandshake: true})
+		_assert(err == nil, "expect handshake sent, got %v", err)
+		var reply string
+		err = client.Call(context.Background(), "Bar.Identity", 1, &reply)
+		_assert(ErrorCode(err) == CodeUnauthenticated, "expect Unauthenticated, got %v", err)
+	})
+}
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"Bar.Sleep", "Bar.Sleep", true},
+		{"Bar.Sleep", "Bar.Sleeps", false},
+		{"Bar.*", "Bar.Sleep", true},
+		{"Bar.*", "Baz.Sleep", false},
+		{"*.Get*", "Bar.GetUser", true},
+		{"*.Get*", "Bar.SetUser", false},
+		{"*", "", true},
+		{"ops-*-admin", "ops-eu-admin", true},
+		{"ops-*-admin", "ops-eu-reader", false},
+	}
+	for _, c := range cases {
+		_assert(matchPattern(c.pattern, c.s) == c.match, "expect match(%q, %q) to be %v", c.pattern, c.s, c.match)
+	}
+}
+
+func TestServer_Policy(t *testing.T) {
+	t.Parallel()
+	server, addr := startShutdownServer(t)
+	server.SetAuthenticator(BearerAuthenticator(func(ctx context.Context, token string) (string, error) {
+		return token, nil
+	}))
+	dial := func(identity string) *Client {
+		client, err := Dial("tcp", addr, &Option{Credentials: BearerCredentials(func(ctx context.Context) (string, error) {
+			return identity, nil
+		})})
+		_assert(err == nil, "expect %s authenticated, got %v", identity, err)
+		return client
+	}
+	reader, admin := dial("billing"), dial("ops-1")
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	_ = os.WriteFile(path, []byte(`{
+		"roles": {"reader": ["Bar.Iden*"], "admin": ["*"]},
+		"identities": {"billing": ["reader"], "ops-*": ["admin"]}
+	}`), 0o644)
+	err := server.LoadPolicyFile(path)
+	_assert(err == nil, "expect policy loaded, got %v", err)
+
+	var s string
+	var n int
+	err = reader.Call(context.Background(), "Bar.Identity", 1, &s)
+	_assert(err == nil && s == "billing", "expect billing allowed, got %v", err)
+	err = reader.Call(context.Background(), "Bar.Sleep", 1, &n)
+	_assert(ErrorCode(err) == CodePermissionDenied, "expect billing denied, got %v", err)
+	err = admin.Call(context.Background(), "Bar.Sleep", 1, &n)
+	_assert(err == nil && n == 1, "expect ops-1 allowed, got %v", err)
+
+	// swap the policy at runtime
+	server.SetPolicy(&Policy{
+		Roles:      map[string][]string{"sleeper": {"Bar.Sleep"}},
+		Identities: map[string][]string{"billing": {"sleeper"}},
+	})
+	err = reader.Call(context.Background(), "Bar.Sleep", 1, &n)
+	_assert(err == nil, "expect billing allowed by new policy, got %v", err)
+	err = admin.Call(context.Background(), "Bar.Sleep", 1, &n)
+	_assert(ErrorCode(err) == CodePermissionDenied, "expect ops-1 denied by new policy, got %v", err)
+
+	err = server.LoadPolicyFile(filepath.Join(t.TempDir(), "missing.json"))
+	_assert(err != nil, "expect missing policy file error")
+	err = reader.Call(context.Background(), "Bar.Sleep", 1, &n)
+	_assert(err == nil, "expect old policy kept, got %v", err)
+}
+
+func TestServer_HandshakeAck(t *testing.T) {
+	t.Parallel()
+	_, addr := startShutdownServer(t)
+
+	client, err := Dial("tcp", addr, &Option{CodecType: codec.JsonType})
+	_assert(err == nil, "expect handshake accepted, got %v", err)
+	ack := client.Handshake()
+	_assert(ack != nil && ack.Version == ProtocolVersion && ack.CodecType == codec.JsonType, "expect ack of version and codec, got %+v", ack)
+	_assert(ack.Has(CapStreaming) && ack.Has(CapMetadata) && !ack.Has(CapAuth), "expect capabilities of server, got %v", ack.Capabilities)
+	_, framed := client.cc.(*codec.FramedCodec)
+	_assert(framed, "expect messages framed since version %d, got %T", framedVersion, client.cc)
+
+	// client only dials with known codecs, so send the option by hand
+	conn, _ := net.Dial("tcp", addr)
+	_ = json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: "application/xml", Version: ProtocolVersion})
+	_, err = readHandshakeAck(json.NewDecoder(conn))
+	_assert(ErrorCode(err) == CodeInvalidArgument && strings.Contains(err.Error(), string(codec.GobType)),
+		"expect unknown codec rejected with supported ones, got %v", err)
+	_ = conn.Close()
+
+	conn, _ = net.Dial("tcp", addr)
+	_, err = NewClient(conn, &Option{MagicNumber: 0x1234, CodecType: codec.GobType})
+	_assert(ErrorCode(err) == CodeInvalidArgument && strings.Contains(err.Error(), "magic number"), "expect bad magic number rejected, got %v", err)
+
+	// clients which don't read the ack still work
+	client, err = Dial("tcp", addr, &Option{LegacyHandshake: true})
+	_assert(err == nil && client.Handshake() == nil, "expect legacy handshake, got %v", err)
+	_, framed = client.cc.(*codec.FramedCodec)
+	_assert(!framed, "expect legacy messages not framed")
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+	_assert(err == nil && reply == 1, "expect Bar.Sleep to work, got %v", err)
+}
+
+// startOldServer starts a server which is older than HandshakeAck,
+// it serves the option without replying to it
+func startOldServer(t *testing.T) string {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	server := NewServer()
+	_ = server.Register(new(Bar))
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				var opt Option
+				if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+					_ = conn.Close()
+					return
+				}
+				server.serveCodec(codec.NewCodecFuncMap[opt.CodecType](conn), &opt, nil)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClient_OldServer(t *testing.T) {
+	t.Parallel()
+	addr := startOldServer(t)
+
+	// client falls back to the legacy handshake once the ack times out
+	start := time.Now()
+	client, err := Dial("tcp", addr, &Option{CodecType: codec.JsonType, AckTimeout: 200 * time.Millisecond})
+	_assert(err == nil && client.Handshake() == nil, "expect fallback to legacy handshake, got %v", err)
+	_assert(time.Since(start) < 2*time.Second, "expect ack timeout, waited %s", time.Since(start))
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+	_assert(err == nil && reply == 1, "expect Bar.Sleep to work, got %v", err)
+	_ = client.Close()
+
+	// old servers can't authenticate client
+	_, err = Dial("tcp", addr, &Option{AckTimeout: 200 * time.Millisecond, Credentials: HMACCredentials("k", []byte("s"))})
+	_assert(err == errNoAck, "expect clear error without ack, got %v", err)
+}
+
+// splitConn writes one byte at a time, like a network which
+// delivers the option and its newline separately
+type splitConn struct{ net.Conn }
+
+func (c splitConn) Write(p []byte) (int, error) {
+	for i := range p {
+		if _, err := c.Conn.Write(p[i : i+1]); err != nil {
+			return i, err
+		}
+		time.Sleep(time.Microsecond)
+	}
+	return len(p), nil
+}
+
+func TestServer_OptionNewline(t *testing.T) {
+	t.Parallel()
+	_, addr := startShutdownServer(t)
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType} {
+		for _, legacy := range []bool{false, true} {
+			conn, _ := net.Dial("tcp", addr)
+			client, err := NewClient(splitConn{conn}, &Option{MagicNumber: MagicNumber, CodecType: typ, LegacyHandshake: legacy})
+			_assert(err == nil, "%s: expect handshake accepted, got %v", typ, err)
+			var reply int
+			err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+			_assert(err == nil && reply == 1, "%s: expect Bar.Sleep to work, got %v", typ, err)
+			_ = client.Close()
+		}
+	}
+
+	// clients which write the option without a newline, such as with
+	// json.Marshal, wait for the ack or start the codec right after it
+	for _, version := range []int{1, 0} {
+		conn, _ := net.Dial("tcp", addr)
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		opt := &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Version: version}
+		b, _ := json.Marshal(opt)
+		_, _ = conn.Write(b)
+		if version > 0 {
+			_, err := readHandshakeAck(json.NewDecoder(conn))
+			_assert(err == nil, "expect ack without newline, got %v", err)
+		}
+		client := newClientCodec(codec.NewGobCodec(conn), opt)
+		var reply int
+		err := client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+		_assert(err == nil && reply == 1, "version %d: expect option without newline, got %v", version, err)
+		_ = client.Close()
+	}
+}
+
+func TestServer_SizeLimits(t *testing.T) {
+	t.Parallel()
+	server, addr := startShutdownServer(t)
+	server.SetSizeLimits(SizeLimits{MaxHeaderSize: 512, MaxBodySize: 1000})
+	big := Profile{Name: strings.Repeat("a", 2000)}
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType, codec.ProtobufType} {
+		client, _ := Dial("tcp", addr, &Option{CodecType: typ})
+		var p Profile
+		err := client.Call(context.Background(), "Bar.Profile", big, &p)
+		_assert(ErrorCode(err) == CodeResourceExhausted, "%s: expect large body rejected, got %v", typ, err)
+		err = client.Call(context.Background(), "Bar.Profile", Profile{Name: "small"}, &p)
+		_assert(err == nil && p.Name == "small", "%s: expect framed connection kept, got %v", typ, err)
+		_ = client.Close()
+
+		// codecs without frames can't skip the body, so the connection is closed
+		client, _ = Dial("tcp", addr, &Option{CodecType: typ, LegacyHandshake: true})
+		err = client.Call(context.Background(), "Bar.Profile", big, &p)
+		_assert(ErrorCode(err) == CodeResourceExhausted, "%s: expect large body rejected without frames, got %v", typ, err)
+		err = client.Call(context.Background(), "Bar.Profile", Profile{Name: "small"}, &p)
+		_assert(err != nil, "%s: expect connection closed without frames", typ)
+		_ = client.Close()
+
+		client, _ = Dial("tcp", addr, &Option{CodecType: typ})
+		err = client.Call(context.Background(), "Bar.Sleep", 1, new(int), WithMetadata(Metadata{"k": strings.Repeat("v", 1000)}))
+		_assert(ErrorCode(err) == CodeResourceExhausted, "%s: expect large header rejected, got %v", typ, err)
+		_ = client.Close()
+	}
+
+	// limits of client bound the replies, including what they decompress to
+	for _, c := range []codec.Compression{"", codec.Gzip, codec.LZ4} {
+		client, _ := Dial("tcp", addr, &Option{CodecType: codec.JsonType, Compression: c, Limits: SizeLimits{MaxBodySize: 10000}})
+		var reply string
+		err := client.Call(context.Background(), "Bar.Export", 1000, &reply)
+		_assert(ErrorCode(err) == CodeResourceExhausted, "%q: expect large reply rejected, got %v", c, err)
+		err = client.Call(context.Background(), "Bar.Export", 10, &reply)
+		_assert(err == nil && len(reply) == 110, "%q: expect small reply, got %v", c, err)
+		_ = client.Close()
+	}
+
+	rec := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/geerpc", nil))
+	_assert(strings.Contains(rec.Body.String(), "512 bytes") && strings.Contains(rec.Body.String(), "1000 bytes"),
+		"expect limits on debug page, got %s", rec.Body.String())
+}
+
+func TestServer_HandshakeTimeout(t *testing.T) {
+	t.Parallel()
+	server, addr := startShutdownServer(t)
+	server.SetHandshakeTimeout(100 * time.Millisecond)
+
+	// a client which sends nothing is disconnected
+	conn, _ := net.Dial("tcp", addr)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	_assert(err == io.EOF, "expect connection closed by server, got %v", err)
+
+	// the deadline doesn't apply once the handshake is done
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "expect handshake accepted, got %v", err)
+	time.Sleep(200 * time.Millisecond)
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+	_assert(err == nil && reply == 1, "expect connection kept after handshake, got %v", err)
+}
@@ -1,12 +1,20 @@
 package simplerpc
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
 	"log"
 	"reflect"
+	"runtime"
 	"sync/atomic"
 )
 
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 type service struct {
 	name   string                 // struct name
 	typ    reflect.Type           // struct type
@@ -32,26 +40,62 @@ func (s *service) registerMethods() {
 	s.method = make(map[string]*methodType)
 
 	// common method func (t *T) MethodName(argType T1, replyType *T2) error
+	// or func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+	// argType can be a ClientStream[T1], replyType can be a ServerStream[T2],
+	// a bidi streaming method takes a single BidiStream[T1, T2] instead
 	for i := 0; i < s.typ.NumMethod(); i++ {
 		method := s.typ.Method(i)
 		// check method format
 		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		if mType.NumOut() != 1 || mType.Out(0) != typeOfError {
 			continue
 		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		in := 1
+		withContext := mType.NumIn() > 1 && mType.In(1) == typeOfContext
+		if withContext {
+			in++
+		}
+
+		var argType, replyType reflect.Type
+		var stream streamDir
+		switch mType.NumIn() - in {
+		case 1:
+			argType = mType.In(in)
+			stream = streamDirection(argType)
+			if stream != streamBidi {
+				continue
+			}
+		case 2:
+			argType, replyType = mType.In(in), mType.In(in+1)
+			argStream, replyStream := streamDirection(argType), streamDirection(replyType)
+			if argStream != 0 && argStream != streamRecv || replyStream != 0 && replyStream != streamSend {
+				continue
+			}
+			// a method streams in both directions with BidiStream
+			if argStream != 0 && replyStream != 0 {
+				continue
+			}
+			if replyType.Kind() != reflect.Ptr && replyStream == 0 {
+				continue
+			}
+			if !isExportedOrBuiltinType(replyType) {
+				continue
+			}
+			stream = argStream | replyStream
+		default:
 			continue
 		}
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		if !isExportedOrBuiltinType(argType) {
 			continue
 		}
 
 		// store method to service
 		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+			method:      method,
+			ArgType:     argType,
+			ReplyType:   replyType,
+			withContext: withContext,
+			stream:      stream,
 		}
 		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
@@ -62,12 +106,35 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-// call use reflect to use method
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+// call use reflect to use method, ctx is only passed to
+// methods which accept a context.Context as first argument.
+// a panic of method is recovered and returned as a CodePanic error
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) (err error) {
 	// add use method cnt
 	atomic.AddUint64(&m.numCalls, 1)
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&m.numPanics, 1)
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("rpc server: %s.%s panic: %v\n%s", s.name, m.method.Name, r, buf)
+			err = &Error{
+				Code:    CodePanic,
+				Message: fmt.Sprintf("rpc server: %s.%s panic: %v", s.name, m.method.Name, r),
+			}
+		}
+	}()
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr}
+	if m.withContext {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	// a bidi streaming method has no reply
+	in = append(in, argv)
+	if replyv.IsValid() {
+		in = append(in, replyv)
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
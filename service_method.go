@@ -7,10 +7,13 @@ import (
 
 // methodType register method type
 type methodType struct {
-	method    reflect.Method
-	ArgType   reflect.Type
-	ReplyType reflect.Type
-	numCalls  uint64 // use method cnt
+	method      reflect.Method
+	ArgType     reflect.Type
+	ReplyType   reflect.Type
+	numCalls    uint64    // use method cnt
+	numPanics   uint64    // recovered panic cnt
+	withContext bool      // method accepts a context.Context as first argument
+	stream      streamDir // direction of stream parameters, 0 means a common method
 }
 
 // NumCalls get method call cnt by atomic
@@ -18,6 +21,11 @@ func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+// NumPanics get method recovered panic cnt by atomic
+func (m *methodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
+
 // newArgv create argv instance
 func (m *methodType) newArgv() reflect.Value {
 	var argv reflect.Value
@@ -32,6 +40,15 @@ func (m *methodType) newArgv() reflect.Value {
 
 // newReplyv create reply instance
 func (m *methodType) newReplyv() reflect.Value {
+	// bidi streaming method has no reply
+	if m.ReplyType == nil {
+		return reflect.Value{}
+	}
+	// stream parameter is bound to the connection before call
+	if m.stream&streamSend != 0 {
+		return reflect.New(m.ReplyType).Elem()
+	}
+
 	// reply must be a pointer type
 	replyv := reflect.New(m.ReplyType.Elem())
 
@@ -1,9 +1,13 @@
 package simplerpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Foo int
@@ -43,6 +47,41 @@ func TestMethodType_Call(t *testing.T) {
 	argv := mType.newArgv()
 	replyv := mType.newReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
+
+type Baz int
+
+func (b Baz) Deadline(ctx context.Context, args int, reply *bool) error {
+	_, *reply = ctx.Deadline()
+	return nil
+}
+
+func TestMethodType_CallContext(t *testing.T) {
+	var baz Baz
+	s := newService(&baz)
+	mType := s.method["Deadline"]
+	_assert(mType != nil && mType.withContext, "wrong Method, Deadline should accept a context")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	argv := mType.newArgv()
+	replyv := mType.newReplyv()
+	err := s.call(ctx, mType, argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*bool), "failed to pass ctx to Baz.Deadline")
+}
+
+func (b Baz) Panic(args int, reply *int) error {
+	panic("baz panic")
+}
+
+func TestMethodType_CallPanic(t *testing.T) {
+	var baz Baz
+	s := newService(&baz)
+	mType := s.method["Panic"]
+
+	err := s.call(context.Background(), mType, mType.newArgv(), mType.newReplyv())
+	_assert(errors.Is(err, ErrPanic) && strings.Contains(err.Error(), "baz panic"), "expect a panic error, got %v", err)
+	_assert(mType.NumCalls() == 1 && mType.NumPanics() == 1, "expect 1 panic, got %d", mType.NumPanics())
+}
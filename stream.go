@@ -0,0 +1,450 @@
+package simplerpc
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+// ErrStreamClosed is returned when using a stream after it is closed
+var ErrStreamClosed = NewError(CodeCanceled, "rpc: stream is closed")
+
+// streamWindow is the number of messages a peer can send on a stream
+// before the receiver grants more, so that a fast producer only
+// blocks itself instead of the connection shared with other calls
+const streamWindow = 64
+
+// streamDir tells in which direction messages of a stream flow
+type streamDir uint8
+
+const (
+	streamSend streamDir = 1 << iota // server sends messages
+	streamRecv                       // server receives messages
+	streamBidi = streamSend | streamRecv
+)
+
+// ServerStream sends messages of type T to the caller of a
+// server-streaming method, the method has the form
+//
+//	func (t *T) MethodName(argType T1, stream ServerStream[T2]) error
+//	func (t *T) MethodName(ctx context.Context, argType T1, stream ServerStream[T2]) error
+//
+// the stream ends when the method returns.
+type ServerStream[T any] struct {
+	s *serverStream
+}
+
+// Send sends m to the caller, it fails once the call is cancelled,
+// timed out or the method has returned
+func (s ServerStream[T]) Send(m T) error {
+	return s.s.send(m)
+}
+
+// Context returns the ctx of the call
+func (s ServerStream[T]) Context() context.Context {
+	return s.s.ctx
+}
+
+func (s *ServerStream[T]) bind(ss *serverStream) {
+	s.s = ss
+}
+
+func (ServerStream[T]) direction() streamDir {
+	return streamSend
+}
+
+// ClientStream receives messages of type T from the caller of a
+// client-streaming method, the method has the form
+//
+//	func (t *T) MethodName(stream ClientStream[T1], replyType *T2) error
+//	func (t *T) MethodName(ctx context.Context, stream ClientStream[T1], replyType *T2) error
+//
+// reply is sent to the caller when the method returns.
+type ClientStream[T any] struct {
+	s *serverStream
+}
+
+// Recv returns the next message from the caller, io.EOF means
+// the caller has finished sending
+func (s ClientStream[T]) Recv() (T, error) {
+	var zero T
+	m, err := s.s.recv()
+	if err != nil {
+		return zero, err
+	}
+	return *(m.(*T)), nil
+}
+
+// Context returns the ctx of the call
+func (s ClientStream[T]) Context() context.Context {
+	return s.s.ctx
+}
+
+func (s *ClientStream[T]) bind(ss *serverStream) {
+	s.s = ss
+	ss.in = newMsgQueue(func() interface{} { return new(T) })
+}
+
+func (ClientStream[T]) direction() streamDir {
+	return streamRecv
+}
+
+// BidiStream receives messages of type Req from the caller and sends
+// messages of type Res to it at the same time, the method has the form
+//
+//	func (t *T) MethodName(stream BidiStream[Req, Res]) error
+//	func (t *T) MethodName(ctx context.Context, stream BidiStream[Req, Res]) error
+//
+// the stream ends when the method returns.
+type BidiStream[Req, Res any] struct {
+	s *serverStream
+}
+
+// Recv returns the next message from the caller, io.EOF means
+// the caller has finished sending
+func (s BidiStream[Req, Res]) Recv() (Req, error) {
+	var zero Req
+	m, err := s.s.recv()
+	if err != nil {
+		return zero, err
+	}
+	return *(m.(*Req)), nil
+}
+
+// Send sends m to the caller
+func (s BidiStream[Req, Res]) Send(m Res) error {
+	return s.s.send(m)
+}
+
+// Context returns the ctx of the call
+func (s BidiStream[Req, Res]) Context() context.Context {
+	return s.s.ctx
+}
+
+func (s *BidiStream[Req, Res]) bind(ss *serverStream) {
+	s.s = ss
+	ss.in = newMsgQueue(func() interface{} { return new(Req) })
+}
+
+func (BidiStream[Req, Res]) direction() streamDir {
+	return streamBidi
+}
+
+// streamBinder is implemented by pointers to stream parameters,
+// it lets server bind a stream of any T to the connection
+type streamBinder interface {
+	bind(ss *serverStream)
+	direction() streamDir
+}
+
+var typeOfStreamBinder = reflect.TypeOf((*streamBinder)(nil)).Elem()
+
+// streamDirection returns the direction of stream parameter t,
+// 0 if t is not a stream parameter
+func streamDirection(t reflect.Type) streamDir {
+	if t.Kind() != reflect.Struct || !reflect.PointerTo(t).Implements(typeOfStreamBinder) {
+		return 0
+	}
+	return reflect.New(t).Interface().(streamBinder).direction()
+}
+
+// msgQueue queues received messages of a stream until they are taken,
+// it grants window to the sender as messages are taken
+type msgQueue struct {
+	newMsg func() interface{} // new a message to decode into
+	grant  func(n int)        // give n more messages of window to the sender
+	mu     sync.Mutex         // protect following
+	queue  []interface{}
+	ended  bool          // no more message will be pushed
+	err    error         // returned by take once queue is failed
+	taken  int           // messages taken since last grant
+	credit int           // messages the sender can send before more is granted
+	ready  chan struct{} // strobes when a message is pushed or queue is ended
+}
+
+func newMsgQueue(newMsg func() interface{}) *msgQueue {
+	return &msgQueue{newMsg: newMsg, credit: streamWindow, ready: make(chan struct{}, 1)}
+}
+
+// errStreamWindow fails a stream whose peer sends beyond the window
+var errStreamWindow = NewError(CodeResourceExhausted, "rpc: stream message beyond the window")
+
+func (q *msgQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// push queues m, it returns false if the sender has used up the
+// window granted to it, m is dropped then
+func (q *msgQueue) push(m interface{}) bool {
+	q.mu.Lock()
+	if q.credit <= 0 {
+		q.mu.Unlock()
+		return false
+	}
+	q.credit--
+	if !q.ended {
+		q.queue = append(q.queue, m)
+	}
+	q.mu.Unlock()
+	q.notify()
+	return true
+}
+
+// end marks that no more message will be pushed, queued messages
+// can still be taken
+func (q *msgQueue) end() {
+	q.mu.Lock()
+	q.ended = true
+	q.mu.Unlock()
+	q.notify()
+}
+
+// close ends q and drops queued messages
+func (q *msgQueue) close() {
+	q.fail(nil)
+}
+
+// fail closes q, take returns err instead of io.EOF if it's not nil
+func (q *msgQueue) fail(err error) {
+	q.mu.Lock()
+	q.ended = true
+	q.queue = nil
+	if q.err == nil {
+		q.err = err
+	}
+	q.mu.Unlock()
+	q.notify()
+}
+
+// take waits for the next message, it returns io.EOF once q is
+// ended and empty, or the error of ctx
+func (q *msgQueue) take(ctx context.Context) (interface{}, error) {
+	for {
+		q.mu.Lock()
+		if len(q.queue) > 0 {
+			m := q.queue[0]
+			q.queue[0] = nil
+			q.queue = q.queue[1:]
+			q.taken++
+			n := 0
+			if q.taken >= streamWindow/2 && !q.ended {
+				n, q.taken = q.taken, 0
+				q.credit += n
+			}
+			q.mu.Unlock()
+			if n > 0 && q.grant != nil {
+				q.grant(n)
+			}
+			return m, nil
+		}
+		if q.ended {
+			err := q.err
+			q.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// sendWindow blocks the sender of a stream when the receiver
+// has no room for more messages
+type sendWindow struct {
+	mu     sync.Mutex // protect following
+	credit int
+	closed bool
+	wake   chan struct{} // closed when credit is granted or window closed
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{credit: streamWindow, wake: make(chan struct{})}
+}
+
+// acquire waits for the window to send a message
+func (w *sendWindow) acquire(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return ErrStreamClosed
+		}
+		if w.credit > 0 {
+			w.credit--
+			w.mu.Unlock()
+			return nil
+		}
+		wake := w.wake
+		w.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *sendWindow) grant(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.credit += n
+	close(w.wake)
+	w.wake = make(chan struct{})
+}
+
+func (w *sendWindow) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.wake)
+	}
+}
+
+// serverStream is the server side of a streaming request on sc
+type serverStream struct {
+	sc     *serverConn
+	req    *request
+	ctx    context.Context
+	in     *msgQueue   // messages from the caller, nil if server only sends
+	out    *sendWindow // window to send messages to the caller
+	mu     sync.Mutex  // protect following
+	closed bool        // end of stream has been sent
+	err    error       // error which ends the stream, whatever the method returns
+}
+
+// newServerStream binds the stream parameters of req to sc, it's
+// done before reading the next request so no message is missed
+func (server *Server) newServerStream(sc *serverConn, req *request) {
+	ss := &serverStream{sc: sc, req: req, ctx: req.ctx, out: newSendWindow()}
+	for _, v := range []reflect.Value{req.argv, req.replyv} {
+		if !v.IsValid() || !v.CanAddr() {
+			continue
+		}
+		if b, ok := v.Addr().Interface().(streamBinder); ok {
+			b.bind(ss)
+		}
+	}
+	if ss.in != nil {
+		ss.in.grant = func(n int) {
+			h := &codec.Header{Seq: req.h.Seq, Kind: codec.KindWindow}
+			server.sendResponse(sc.cc, h, uint32(n), sc.sending)
+		}
+	}
+	req.stream = ss
+	sc.streams.Store(req.h.Seq, ss)
+}
+
+func (ss *serverStream) send(m interface{}) error {
+	if err := ss.ctx.Err(); err != nil {
+		return toError(err)
+	}
+	if err := ss.out.acquire(ss.ctx); err != nil {
+		return toError(err)
+	}
+	// hold mu while writing so that no message is sent after the end
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return ErrStreamClosed
+	}
+	h := &codec.Header{
+		ServiceMethod: ss.req.h.ServiceMethod,
+		Seq:           ss.req.h.Seq,
+		Kind:          codec.KindStream,
+	}
+	ss.sc.sending.Lock()
+	defer ss.sc.sending.Unlock()
+	return ss.sc.cc.Write(h, m)
+}
+
+func (ss *serverStream) recv() (interface{}, error) {
+	m, err := ss.in.take(ss.ctx)
+	if err != nil && err != io.EOF {
+		return nil, toError(err)
+	}
+	return m, err
+}
+
+// fail ends the stream with err, the method is cancelled
+// and gets err from Recv
+func (ss *serverStream) fail(err error) {
+	ss.mu.Lock()
+	if ss.err == nil {
+		ss.err = err
+	}
+	ss.mu.Unlock()
+	ss.in.fail(err)
+	ss.req.cancel()
+}
+
+// failure returns the error passed to fail
+func (ss *serverStream) failure() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.err
+}
+
+// close stops the stream, it's called before the end of
+// stream is sent
+func (ss *serverStream) close() {
+	ss.sc.streams.Delete(ss.req.h.Seq)
+	ss.out.close()
+	if ss.in != nil {
+		ss.in.close()
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.closed = true
+}
+
+// receiveStream reads a stream message sent by client on sc
+func (server *Server) receiveStream(sc *serverConn, h *codec.Header) error {
+	var ss *serverStream
+	if v, ok := sc.streams.Load(h.Seq); ok {
+		ss = v.(*serverStream)
+	}
+
+	switch {
+	case h.Kind == codec.KindWindow:
+		var n uint32
+		if err := sc.cc.ReadBody(&n); err != nil {
+			return err
+		}
+		if ss != nil {
+			ss.out.grant(int(n))
+		}
+		return nil
+	case h.Kind == codec.KindStream && ss != nil && ss.in != nil:
+		m := ss.in.newMsg()
+		if err := sc.cc.ReadBody(m); err != nil {
+			return err
+		}
+		// client doesn't wait for the window, the stream can't go on
+		if !ss.in.push(m) {
+			ss.fail(errStreamWindow)
+		}
+		return nil
+	case h.Kind == codec.KindStreamEnd && ss != nil && ss.in != nil:
+		ss.in.end()
+	}
+	// stream is finished or doesn't receive messages
+	return sc.cc.ReadBody(nil)
+}
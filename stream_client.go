@@ -0,0 +1,308 @@
+package simplerpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+// clientStream is the client side of a streaming call, messages
+// received by Client.receive are queued until they are taken
+type clientStream struct {
+	recv *msgQueue   // messages from server, nil if client only sends
+	send *sendWindow // window to send messages to server, nil if client only receives
+}
+
+// finish ends the stream, it's called when the call is done
+func (s *clientStream) finish() {
+	if s.recv != nil {
+		s.recv.end()
+	}
+	if s.send != nil {
+		s.send.close()
+	}
+}
+
+// receiveStream reads a message or window update of the streaming call with h.Seq
+func (client *Client) receiveStream(h *codec.Header) error {
+	client.mu.Lock()
+	call := client.pending[h.Seq]
+	client.mu.Unlock()
+
+	switch {
+	case call == nil || call.stream == nil:
+		// call was cancelled or not a stream
+	case h.Kind == codec.KindWindow && call.stream.send != nil:
+		var n uint32
+		if err := client.cc.ReadBody(&n); err != nil {
+			return err
+		}
+		call.stream.send.grant(int(n))
+		return nil
+	case h.Kind == codec.KindStream && call.stream.recv != nil:
+		m := call.stream.recv.newMsg()
+		if err := client.cc.ReadBody(m); err != nil {
+			return err
+		}
+		// server doesn't wait for the window, give up the call
+		if !call.stream.recv.push(m) && client.removeCall(h.Seq) != nil {
+			client.cancel(h.Seq)
+			call.Error = errStreamWindow
+			call.done()
+		}
+		return nil
+	}
+	return client.cc.ReadBody(nil)
+}
+
+// writeStream sends a message of kind on the streaming call with seq
+func (client *Client) writeStream(seq uint64, kind codec.Kind, body interface{}) error {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	// running streams go on after server has told us to stop
+	client.mu.Lock()
+	closing := client.closing
+	client.mu.Unlock()
+	if closing {
+		return ErrShutdown
+	}
+
+	client.header.ServiceMethod = ""
+	client.header.Seq = seq
+	client.header.Error = ""
+	client.header.Kind = kind
+	client.header.Timeout = 0
+	client.header.Metadata = nil
+	return client.cc.Write(&client.header, body)
+}
+
+// streamCall is the state of a streaming call shared by
+// StreamReceiver, StreamSender and BidiStreamClient
+type streamCall struct {
+	ctx        context.Context
+	client     *Client
+	call       *Call
+	ended      chan struct{} // closed when the call is done
+	err        error         // error of the call, valid after ended is closed
+	sendClosed bool          // CloseSend has been called
+}
+
+// startStream sends the request of a streaming call, the messages
+// of the stream follow it
+func startStream(ctx context.Context, client *Client, serviceMethod string, args, reply interface{}, cs *clientStream) (*streamCall, error) {
+	s := &streamCall{ctx: ctx, client: client, ended: make(chan struct{})}
+	s.call = &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+		ctx:           ctx,
+		stream:        cs,
+	}
+	if cs.recv != nil {
+		// let server send more once half of the window is taken
+		cs.recv.grant = func(n int) {
+			_ = client.writeStream(s.call.Seq, codec.KindWindow, uint32(n))
+		}
+	}
+	client.send(s.call)
+	if s.call.Seq == 0 {
+		// call failed before it was sent
+		<-s.call.Done
+		return nil, s.call.Error
+	}
+	go func() {
+		call := <-s.call.Done
+		s.err = call.Error
+		close(s.ended)
+	}()
+	return s, nil
+}
+
+// recv returns the next message of the stream, io.EOF
+// if the method has returned without error
+func (s *streamCall) recv() (interface{}, error) {
+	m, err := s.call.stream.recv.take(s.ctx)
+	if err == nil {
+		return m, nil
+	}
+	if err == io.EOF {
+		// messages are queued before the end of stream arrives
+		<-s.ended
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	s.close()
+	return nil, toError(fmt.Errorf("rpc client: stream failed: %w", err))
+}
+
+// send sends m to server, it returns io.EOF if the stream has ended,
+// the error of the call is returned by recv or wait
+func (s *streamCall) send(m interface{}) error {
+	if s.sendClosed {
+		return ErrStreamClosed
+	}
+	if err := s.call.stream.send.acquire(s.ctx); err != nil {
+		if err == ErrStreamClosed {
+			return io.EOF
+		}
+		s.close()
+		return toError(fmt.Errorf("rpc client: stream failed: %w", err))
+	}
+	return s.client.writeStream(s.call.Seq, codec.KindStream, m)
+}
+
+// closeSend tells server that no more message will be sent
+func (s *streamCall) closeSend() error {
+	if s.sendClosed {
+		return nil
+	}
+	s.sendClosed = true
+	return s.client.writeStream(s.call.Seq, codec.KindStreamEnd, invalidRequest)
+}
+
+// wait waits for the call to be done and returns its error
+func (s *streamCall) wait() error {
+	select {
+	case <-s.ended:
+		return s.err
+	case <-s.ctx.Done():
+		s.close()
+		return toError(fmt.Errorf("rpc client: stream failed: %w", s.ctx.Err()))
+	}
+}
+
+// close stops the stream and cancels the call on server
+func (s *streamCall) close() {
+	if call := s.client.removeCall(s.call.Seq); call != nil {
+		s.client.cancel(call.Seq)
+		call.Error = ErrStreamClosed
+		call.done()
+	}
+}
+
+// StreamReceiver receives the messages of a server-streaming call
+type StreamReceiver[T any] struct {
+	s *streamCall
+}
+
+// StreamCall starts a server-streaming call of serviceMethod with args,
+// messages of type T are received with the returned StreamReceiver
+func StreamCall[T any](ctx context.Context, client *Client, serviceMethod string, args interface{}) (*StreamReceiver[T], error) {
+	cs := &clientStream{recv: newMsgQueue(func() interface{} { return new(T) })}
+	s, err := startStream(ctx, client, serviceMethod, args, nil, cs)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReceiver[T]{s: s}, nil
+}
+
+// Recv returns the next message of the stream. It returns io.EOF
+// when the method has returned without error, otherwise the error
+// of the method or the call.
+func (r *StreamReceiver[T]) Recv() (T, error) {
+	var zero T
+	m, err := r.s.recv()
+	if err != nil {
+		return zero, err
+	}
+	return *(m.(*T)), nil
+}
+
+// Close stops receiving messages and cancels the call on server
+func (r *StreamReceiver[T]) Close() error {
+	r.s.close()
+	return nil
+}
+
+// StreamSender sends the messages of a client-streaming call
+type StreamSender[T any] struct {
+	s *streamCall
+}
+
+// ClientStreamCall starts a client-streaming call of serviceMethod,
+// messages of type T are sent with the returned StreamSender and
+// reply is filled when the method returns
+func ClientStreamCall[T any](ctx context.Context, client *Client, serviceMethod string, reply interface{}) (*StreamSender[T], error) {
+	cs := &clientStream{send: newSendWindow()}
+	s, err := startStream(ctx, client, serviceMethod, invalidRequest, reply, cs)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamSender[T]{s: s}, nil
+}
+
+// Send sends m to server, it blocks while server has no room for
+// more messages. It returns io.EOF if the method has already
+// returned, the error is returned by CloseAndRecv.
+func (w *StreamSender[T]) Send(m T) error {
+	return w.s.send(m)
+}
+
+// CloseAndRecv tells server that all messages are sent and
+// waits for the reply
+func (w *StreamSender[T]) CloseAndRecv() error {
+	if err := w.s.closeSend(); err != nil {
+		w.s.close()
+		return err
+	}
+	return w.s.wait()
+}
+
+// Close stops sending messages and cancels the call on server
+func (w *StreamSender[T]) Close() error {
+	w.s.close()
+	return nil
+}
+
+// BidiStreamClient sends messages of type Req to server and receives
+// messages of type Res from it at the same time. Recv can be called
+// in a goroutine other than Send and CloseSend.
+type BidiStreamClient[Req, Res any] struct {
+	s *streamCall
+}
+
+// BidiStreamCall starts a bidi streaming call of serviceMethod
+func BidiStreamCall[Req, Res any](ctx context.Context, client *Client, serviceMethod string) (*BidiStreamClient[Req, Res], error) {
+	cs := &clientStream{
+		recv: newMsgQueue(func() interface{} { return new(Res) }),
+		send: newSendWindow(),
+	}
+	s, err := startStream(ctx, client, serviceMethod, invalidRequest, nil, cs)
+	if err != nil {
+		return nil, err
+	}
+	return &BidiStreamClient[Req, Res]{s: s}, nil
+}
+
+// Send sends m to server, it returns io.EOF if the method has
+// already returned, the error is returned by Recv
+func (b *BidiStreamClient[Req, Res]) Send(m Req) error {
+	return b.s.send(m)
+}
+
+// CloseSend tells server that no more message will be sent
+func (b *BidiStreamClient[Req, Res]) CloseSend() error {
+	return b.s.closeSend()
+}
+
+// Recv returns the next message from server, io.EOF means the
+// method has returned without error
+func (b *BidiStreamClient[Req, Res]) Recv() (Res, error) {
+	var zero Res
+	m, err := b.s.recv()
+	if err != nil {
+		return zero, err
+	}
+	return *(m.(*Res)), nil
+}
+
+// Close stops the stream and cancels the call on server
+func (b *BidiStreamClient[Req, Res]) Close() error {
+	b.s.close()
+	return nil
+}
@@ -0,0 +1,237 @@
+package simplerpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ChenMiaoQiu/simple-rpc/codec"
+)
+
+type Page struct {
+	Index int
+	Items []string
+}
+
+type Pager int
+
+func (p Pager) List(n int, stream ServerStream[*Page]) error {
+	for i := 0; i < n; i++ {
+		if err := stream.Send(&Page{Index: i, Items: []string{"a", "b"}}); err != nil {
+			return err
+		}
+	}
+	if n > 3 {
+		return NewError(CodeResourceExhausted, "too many pages")
+	}
+	return nil
+}
+
+// pagerTailed receives the error of Send after Pager.Tail is cancelled
+var pagerTailed = make(chan error, 1)
+
+func (p Pager) Tail(ctx context.Context, n int, stream ServerStream[int]) error {
+	for i := 0; ; i++ {
+		if err := stream.Send(i); err != nil {
+			pagerTailed <- err
+			return err
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func startPagerServer(t *testing.T) string {
+	var p Pager
+	server, addr := startShutdownServer(t)
+	_ = server.Register(&p)
+	return addr
+}
+
+func TestStreamCall(t *testing.T) {
+	t.Parallel()
+	addr := startPagerServer(t)
+	client, _ := Dial("tcp", addr)
+
+	t.Run("pages", func(t *testing.T) {
+		r, err := StreamCall[*Page](context.Background(), client, "Pager.List", 3)
+		_assert(err == nil, "expect stream started, got %v", err)
+		for i := 0; i < 3; i++ {
+			page, err := r.Recv()
+			_assert(err == nil && page.Index == i && len(page.Items) == 2, "expect page %d, got %v %v", i, page, err)
+		}
+		_, err = r.Recv()
+		_assert(err == io.EOF, "expect io.EOF, got %v", err)
+	})
+	t.Run("error after messages", func(t *testing.T) {
+		r, _ := StreamCall[*Page](context.Background(), client, "Pager.List", 5)
+		n := 0
+		var err error
+		for err == nil {
+			if _, err = r.Recv(); err == nil {
+				n++
+			}
+		}
+		_assert(n == 5 && ErrorCode(err) == CodeResourceExhausted, "expect 5 pages and an error, got %d %v", n, err)
+	})
+	t.Run("close", func(t *testing.T) {
+		r, _ := StreamCall[int](context.Background(), client, "Pager.Tail", 0)
+		for i := 0; i < 3; i++ {
+			v, err := r.Recv()
+			_assert(err == nil && v == i, "expect %d, got %d %v", i, v, err)
+		}
+		_ = r.Close()
+		select {
+		case err := <-pagerTailed:
+			_assert(errors.Is(err, context.Canceled), "expect Send cancelled, got %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("expect server to stop Pager.Tail")
+		}
+		_, err := r.Recv()
+		_assert(errors.Is(err, ErrStreamClosed), "expect ErrStreamClosed, got %v", err)
+
+		// normal calls still work on the same client
+		var reply int
+		err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+		_assert(err == nil && reply == 1, "expect Bar.Sleep to work, got %v", err)
+	})
+}
+
+func (p Pager) Sum(stream ClientStream[int], reply *int) error {
+	for {
+		v, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		*reply += v
+	}
+}
+
+func (p Pager) Echo(ctx context.Context, stream BidiStream[string, string]) error {
+	for {
+		s, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send("echo " + s); err != nil {
+			return err
+		}
+	}
+}
+
+// pagerFlooded counts the messages sent by Pager.Flood
+var pagerFlooded int64
+
+func (p Pager) Flood(n int, stream ServerStream[int]) error {
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+		atomic.AddInt64(&pagerFlooded, 1)
+	}
+	return nil
+}
+
+// Hold never reads the stream, so that the window of client runs out
+func (p Pager) Hold(ctx context.Context, stream ClientStream[int], reply *int) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestStreamWindowEnforced(t *testing.T) {
+	t.Parallel()
+	addr := startPagerServer(t)
+	client, _ := Dial("tcp", addr)
+
+	var reply int
+	w, err := ClientStreamCall[int](context.Background(), client, "Pager.Hold", &reply)
+	_assert(err == nil, "expect stream started, got %v", err)
+	// a client which ignores the window writes messages directly
+	for i := 0; i <= streamWindow; i++ {
+		err = client.writeStream(w.s.call.Seq, codec.KindStream, i)
+		_assert(err == nil, "expect message written, got %v", err)
+	}
+	err = w.s.wait()
+	_assert(ErrorCode(err) == CodeResourceExhausted, "expect stream beyond the window failed, got %v", err)
+
+	// the connection is still usable
+	var sum int
+	w, _ = ClientStreamCall[int](context.Background(), client, "Pager.Sum", &sum)
+	_ = w.Send(1)
+	err = w.CloseAndRecv()
+	_assert(err == nil && sum == 1, "expect next stream to work, got %d %v", sum, err)
+}
+
+func TestClientStreamCall(t *testing.T) {
+	t.Parallel()
+	addr := startPagerServer(t)
+	client, _ := Dial("tcp", addr)
+
+	var sum int
+	w, err := ClientStreamCall[int](context.Background(), client, "Pager.Sum", &sum)
+	_assert(err == nil, "expect stream started, got %v", err)
+	// more messages than the window, so that Send waits for server
+	for i := 1; i <= 200; i++ {
+		err = w.Send(i)
+		_assert(err == nil, "expect Send to work, got %v", err)
+	}
+	err = w.CloseAndRecv()
+	_assert(err == nil && sum == 200*201/2, "expect sum %d, got %d %v", 200*201/2, sum, err)
+}
+
+func TestBidiStreamCall(t *testing.T) {
+	t.Parallel()
+	addr := startPagerServer(t)
+	client, _ := Dial("tcp", addr)
+
+	b, err := BidiStreamCall[string, string](context.Background(), client, "Pager.Echo")
+	_assert(err == nil, "expect stream started, got %v", err)
+	go func() {
+		for i := 0; i < 100; i++ {
+			_ = b.Send(fmt.Sprintf("msg %d", i))
+		}
+		_ = b.CloseSend()
+	}()
+	for i := 0; i < 100; i++ {
+		s, err := b.Recv()
+		_assert(err == nil && s == fmt.Sprintf("echo msg %d", i), "expect echo msg %d, got %q %v", i, s, err)
+	}
+	_, err = b.Recv()
+	_assert(err == io.EOF, "expect io.EOF, got %v", err)
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	t.Parallel()
+	addr := startPagerServer(t)
+	client, _ := Dial("tcp", addr)
+
+	n := streamWindow * 4
+	atomic.StoreInt64(&pagerFlooded, 0)
+	r, err := StreamCall[int](context.Background(), client, "Pager.Flood", n)
+	_assert(err == nil, "expect stream started, got %v", err)
+
+	// server stops sending once the window is used up, and the
+	// slow receiver doesn't block other calls on the same client
+	time.Sleep(time.Millisecond * 100)
+	sent := atomic.LoadInt64(&pagerFlooded)
+	_assert(sent == streamWindow, "expect %d messages sent, got %d", streamWindow, sent)
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+	_assert(err == nil && reply == 1, "expect Bar.Sleep to work, got %v", err)
+
+	for i := 0; i < n; i++ {
+		v, err := r.Recv()
+		_assert(err == nil && v == i, "expect %d, got %d %v", i, v, err)
+	}
+	_, err = r.Recv()
+	_assert(err == io.EOF, "expect io.EOF, got %v", err)
+}
@@ -0,0 +1,65 @@
+package simplerpc
+
+import (
+	"strings"
+	"time"
+)
+
+// TimeoutPolicy is the handle timeout policy enforced by server,
+// 0 means no limit for every duration
+type TimeoutPolicy struct {
+	// Default is used when the client doesn't set Option.HandleTimeout
+	Default time.Duration
+	// Max is the upper bound of the handle timeout asked by client
+	Max time.Duration
+	// Overrides replace Max for a service or a method, keyed by
+	// "Service" or "Service.Method", the method one wins, they are
+	// clamped to Max so a method can't run longer than Max either
+	Overrides map[string]time.Duration
+}
+
+// SetTimeoutPolicy sets the handle timeout policy of server
+func (server *Server) SetTimeoutPolicy(policy TimeoutPolicy) {
+	overrides := make(map[string]time.Duration, len(policy.Overrides))
+	for name, d := range policy.Overrides {
+		overrides[name] = d
+	}
+	policy.Overrides = overrides
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.timeouts = policy
+}
+
+// SetTimeoutPolicy sets the handle timeout policy of the DefaultServer.
+func SetTimeoutPolicy(policy TimeoutPolicy) { DefaultServer.SetTimeoutPolicy(policy) }
+
+// handleTimeout returns the effective handle timeout of req, which is
+// the minimum of server policy, the handle timeout asked by client
+// and the caller's remaining deadline
+func (server *Server) handleTimeout(req *request, asked time.Duration) time.Duration {
+	server.mu.Lock()
+	policy := server.timeouts
+	server.mu.Unlock()
+
+	limit := policy.Max
+	if d, ok := policy.Overrides[req.h.ServiceMethod]; ok {
+		limit = minTimeout(d, policy.Max)
+	} else if dot := strings.LastIndex(req.h.ServiceMethod, "."); dot >= 0 {
+		if d, ok := policy.Overrides[req.h.ServiceMethod[:dot]]; ok {
+			limit = minTimeout(d, policy.Max)
+		}
+	}
+	if asked == 0 {
+		asked = policy.Default
+	}
+	return minTimeout(minTimeout(asked, limit), req.h.Timeout)
+}
+
+// minTimeout returns the smaller timeout, 0 means no limit
+func minTimeout(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
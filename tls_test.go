@@ -0,0 +1,162 @@
+package simplerpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self-signed certificate of cn, valid for
+// localhost, and a pool which trusts it
+func newTestCert(t *testing.T, cn string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestAcceptTLS(t *testing.T) {
+	t.Parallel()
+	cert, pool := newTestCert(t, "localhost")
+	var b Bar
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := NewServer()
+	_ = server.Register(&b)
+	go server.AcceptTLS(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	addr := l.Addr().String()
+
+	t.Run("dial", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{TLSConfig: &tls.Config{RootCAs: pool}})
+		_assert(err == nil, "expect dial over TLS, got %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+		_assert(err == nil && reply == 1, "expect Bar.Sleep over TLS, got %v", err)
+	})
+	t.Run("xdial", func(t *testing.T) {
+		client, err := XDial("tls@"+addr, &Option{TLSConfig: &tls.Config{RootCAs: pool}})
+		_assert(err == nil, "expect XDial over TLS, got %v", err)
+		var reply int
+		err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+		_assert(err == nil && reply == 1, "expect Bar.Sleep over TLS, got %v", err)
+	})
+	t.Run("untrusted", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{TLSConfig: &tls.Config{}})
+		if err == nil {
+			var reply int
+			err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+		}
+		_assert(err != nil, "expect certificate of server not trusted")
+	})
+	t.Run("plaintext", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{ConnectTimeout: time.Second})
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			var reply int
+			err = client.Call(ctx, "Bar.Sleep", 1, &reply)
+		}
+		_assert(err != nil, "expect plaintext client to fail")
+	})
+}
+
+func TestDialHTTP_TLS(t *testing.T) {
+	t.Parallel()
+	cert, pool := newTestCert(t, "localhost")
+	var b Bar
+	server := NewServer()
+	_ = server.Register(&b)
+	mux := http.NewServeMux()
+	mux.Handle(defaultRPCPath, server)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		_ = http.Serve(tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}}), mux)
+	}()
+
+	client, err := XDial("https@"+l.Addr().String(), &Option{TLSConfig: &tls.Config{RootCAs: pool}})
+	_assert(err == nil, "expect CONNECT over TLS, got %v", err)
+	var reply int
+	err = client.Call(context.Background(), "Bar.Sleep", 1, &reply)
+	_assert(err == nil && reply == 1, "expect Bar.Sleep over TLS, got %v", err)
+}
+
+func (b Bar) Whoami(ctx context.Context, argv int, reply *string) error {
+	p, ok := PeerFromContext(ctx)
+	if !ok || p.Addr == nil {
+		return errors.New("no peer")
+	}
+	if !p.Authenticated() {
+		*reply = "anonymous"
+		return nil
+	}
+	*reply = p.Subject.CommonName + " " + strings.Join(p.SANs, ",")
+	return nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	t.Parallel()
+	serverCert, serverPool := newTestCert(t, "localhost")
+	clientCert, clientPool := newTestCert(t, "billing")
+	var b Bar
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := NewServer()
+	_ = server.Register(&b)
+	go server.AcceptTLS(l, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	})
+	addr := l.Addr().String()
+
+	client, err := Dial("tcp", addr, &Option{TLSConfig: &tls.Config{
+		RootCAs:      serverPool,
+		Certificates: []tls.Certificate{clientCert},
+	}})
+	_assert(err == nil, "expect dial over mutual TLS, got %v", err)
+	var reply string
+	err = client.Call(context.Background(), "Bar.Whoami", 1, &reply)
+	_assert(err == nil && reply == "billing localhost,127.0.0.1", "expect identity of client, got %q %v", reply, err)
+
+	// client without certificate is rejected
+	client, err = Dial("tcp", addr, &Option{TLSConfig: &tls.Config{RootCAs: serverPool}})
+	if err == nil {
+		err = client.Call(context.Background(), "Bar.Whoami", 1, &reply)
+	}
+	_assert(err != nil, "expect client without certificate rejected")
+
+	// peer of a plaintext connection has no identity
+	_, plainAddr := startShutdownServer(t)
+	client, _ = Dial("tcp", plainAddr)
+	err = client.Call(context.Background(), "Bar.Whoami", 1, &reply)
+	_assert(err == nil && reply == "anonymous", "expect anonymous peer, got %q %v", reply, err)
+}
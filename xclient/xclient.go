@@ -71,23 +71,23 @@ func (xc *XClient) dial(rpcAddr string) (*simplerpc.Client, error) {
 }
 
 // call connect rpc and handle request
-func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}, opts ...simplerpc.CallOption) error {
 	client, err := xc.dial(rpcAddr)
 	if err != nil {
 		return err
 	}
-	return client.Call(ctx, serviceMethod, args, reply)
+	return client.Call(ctx, serviceMethod, args, reply, opts...)
 }
 
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
 // xc will choose a proper server.
-func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}, opts ...simplerpc.CallOption) error {
 	rpcAddr, err := xc.d.Get(xc.mode)
 	if err != nil {
 		return err
 	}
-	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	return xc.call(rpcAddr, ctx, serviceMethod, args, reply, opts...)
 }
 
 // Broadcast invokes the named function for every server registered in discovery
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -106,3 +107,32 @@ func TestMain(t *testing.T) {
 	call(addr1, addr2)
 	broadcast(addr1, addr2)
 }
+
+func TestXClient_Interceptors(t *testing.T) {
+	ch1 := make(chan string)
+	ch2 := make(chan string)
+	go startServer(ch1)
+	go startServer(ch2)
+	d := NewMultiServerDiscovery([]string{"tcp@" + <-ch1, "tcp@" + <-ch2})
+
+	var calls int32
+	opt := &simplerpc.Option{Interceptors: []simplerpc.ClientInterceptor{
+		func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker simplerpc.Invoker) error {
+			atomic.AddInt32(&calls, 1)
+			return invoker(ctx, serviceMethod, args, reply)
+		},
+	}}
+	xc := NewXClient(d, RoundRobinSelect, opt)
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	if err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+		t.Fatalf("call Foo.Sum error: %v %d", err, reply)
+	}
+	if err := xc.Broadcast(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil {
+		t.Fatal("broadcast Foo.Sum error:", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expect 3 intercepted calls, got %d", n)
+	}
+}